@@ -0,0 +1,232 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	_ "time/tzdata" // The image may have no zoneinfo
+)
+
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+	DriverMemory   = "memory"
+
+	SchedulerTable = "table"
+	SchedulerSM2   = "sm2"
+)
+
+// Telegram accepts 1-256 characters A-Z, a-z, 0-9, _ and - as a webhook secret
+var webhookSecretRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+type Config struct {
+	Token        string         `json:"token"`
+	Timezone     string         `json:"timezone"`      // IANA name, e.g. Asia/Krasnoyarsk
+	ReminderTime string         `json:"reminder_time"` // HH:MM in Timezone
+	Scheduler    string         `json:"scheduler"`
+	Database     DatabaseConfig `json:"database"`
+	Webhook      WebhookConfig  `json:"webhook"`
+
+	// Parsed by Validate
+	Location       *time.Location `json:"-"`
+	ReminderHour   int            `json:"-"`
+	ReminderMinute int            `json:"-"`
+}
+
+type DatabaseConfig struct {
+	Driver string `json:"driver"`
+	// Connection string for postgres, file path for sqlite
+	DSN string `json:"dsn"`
+}
+
+// WebhookConfig switches the bot from long polling to a webhook when URL is set
+type WebhookConfig struct {
+	URL    string `json:"url"`    // Public HTTPS URL Telegram posts updates to
+	Listen string `json:"listen"` // Address to listen on
+	Path   string `json:"path"`   // Path to serve, the path of URL by default
+	Secret string `json:"secret"` // Required, checked against the X-Telegram-Bot-Api-Secret-Token header
+	// TLS certificate and key, leave them empty behind a TLS terminating reverse proxy
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+func defaults() *Config {
+	return &Config{
+		Timezone:     "Asia/Krasnoyarsk",
+		ReminderTime: "04:30",
+		Scheduler:    SchedulerTable,
+		Database: DatabaseConfig{
+			Driver: DriverPostgres,
+		},
+		Webhook: WebhookConfig{
+			Listen: ":8443",
+		},
+	}
+}
+
+// Load reads the optional JSON file at path, then applies environment variables on top and validates the result
+func Load(path string) (*Config, error) {
+	c := defaults()
+
+	if path != "" {
+		err := c.loadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.loadEnv()
+
+	err := c.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(c)
+
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (c *Config) loadEnv() {
+	env := map[string]*string{
+		"token":         &c.Token,
+		"timezone":      &c.Timezone,
+		"reminder_time": &c.ReminderTime,
+		"scheduler":     &c.Scheduler,
+		"database":      &c.Database.Driver,
+		"database_dsn":  &c.Database.DSN,
+
+		"webhook_url":    &c.Webhook.URL,
+		"webhook_listen": &c.Webhook.Listen,
+		"webhook_path":   &c.Webhook.Path,
+		"webhook_secret": &c.Webhook.Secret,
+		"webhook_cert":   &c.Webhook.CertFile,
+		"webhook_key":    &c.Webhook.KeyFile,
+	}
+
+	for name, value := range env {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			*value = v
+		}
+	}
+}
+
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Token == "" {
+		problems = append(problems, "token is required")
+	}
+
+	location, err := time.LoadLocation(c.Timezone)
+
+	// Local is the time zone of the server, not a real one, and Postgres does not know it
+	if err != nil || c.Timezone == "" || c.Timezone == "Local" {
+		problems = append(problems, fmt.Sprintf("unknown timezone %q", c.Timezone))
+	} else {
+		c.Location = location
+	}
+
+	reminder, err := time.Parse("15:04", c.ReminderTime)
+
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("reminder_time %q is not HH:MM", c.ReminderTime))
+	} else {
+		c.ReminderHour = reminder.Hour()
+		c.ReminderMinute = reminder.Minute()
+	}
+
+	switch c.Scheduler {
+	case SchedulerTable, SchedulerSM2:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown scheduler %q", c.Scheduler))
+	}
+
+	switch c.Database.Driver {
+	case DriverPostgres:
+		if c.Database.DSN == "" {
+			problems = append(problems, "database dsn is required for postgres")
+		}
+	case DriverSQLite:
+		if c.Database.DSN == "" {
+			c.Database.DSN = "osat.sqlite"
+		}
+	case DriverMemory:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown database driver %q", c.Database.Driver))
+	}
+
+	problems = append(problems, c.Webhook.validate()...)
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func (w *WebhookConfig) validate() []string {
+	if w.URL == "" {
+		return nil
+	}
+
+	var problems []string
+
+	u, err := url.Parse(w.URL)
+
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("webhook url %q is not an https URL", w.URL))
+	} else if w.Path == "" {
+		w.Path = u.Path
+	}
+
+	if w.Path == "" {
+		w.Path = "/"
+	}
+
+	if !strings.HasPrefix(w.Path, "/") {
+		problems = append(problems, fmt.Sprintf("webhook path %q must start with /", w.Path))
+	}
+
+	if w.Listen == "" {
+		problems = append(problems, "webhook listen address is required")
+	}
+
+	if w.Secret == "" {
+		problems = append(problems, "webhook secret is required, otherwise anybody could post updates")
+	} else if !webhookSecretRegex.MatchString(w.Secret) {
+		problems = append(problems, "webhook secret may only have 1-256 characters A-Z, a-z, 0-9, _ and -")
+	}
+
+	if (w.CertFile == "") != (w.KeyFile == "") {
+		problems = append(problems, "webhook cert_file and key_file go together")
+	}
+
+	return problems
+}
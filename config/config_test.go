@@ -0,0 +1,93 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		problem string // Part of the error, empty for a valid config
+	}{
+		{"defaults with a dsn", func(c *Config) {}, ""},
+		{"no token", func(c *Config) { c.Token = "" }, "token is required"},
+		{"unknown timezone", func(c *Config) { c.Timezone = "Mars/Olympus" }, `unknown timezone "Mars/Olympus"`},
+		{"empty timezone", func(c *Config) { c.Timezone = "" }, `unknown timezone ""`},
+		{"local timezone", func(c *Config) { c.Timezone = "Local" }, `unknown timezone "Local"`},
+		{"utc", func(c *Config) { c.Timezone = "UTC" }, ""},
+		{"bad reminder time", func(c *Config) { c.ReminderTime = "25:00" }, `reminder_time "25:00" is not HH:MM`},
+		{"sm2", func(c *Config) { c.Scheduler = SchedulerSM2 }, ""},
+		{"unknown scheduler", func(c *Config) { c.Scheduler = "leitner" }, `unknown scheduler "leitner"`},
+		{"postgres without dsn", func(c *Config) { c.Database.DSN = "" }, "database dsn is required for postgres"},
+		{"sqlite without dsn", func(c *Config) { c.Database = DatabaseConfig{Driver: DriverSQLite} }, ""},
+		{"memory", func(c *Config) { c.Database = DatabaseConfig{Driver: DriverMemory} }, ""},
+		{"unknown driver", func(c *Config) { c.Database.Driver = "mysql" }, `unknown database driver "mysql"`},
+		{"webhook", func(c *Config) { c.Webhook.URL = "https://bot.example.com/hook"; c.Webhook.Secret = "s3cret_-" }, ""},
+		{"webhook over http", func(c *Config) { c.Webhook.URL = "http://bot.example.com"; c.Webhook.Secret = "s" }, "is not an https URL"},
+		{"webhook without secret", func(c *Config) { c.Webhook.URL = "https://bot.example.com" }, "webhook secret is required"},
+		{"webhook with a bad secret", func(c *Config) { c.Webhook.URL = "https://bot.example.com"; c.Webhook.Secret = "a b" }, "webhook secret may only have"},
+		{"webhook with a bad path", func(c *Config) {
+			c.Webhook.URL = "https://bot.example.com"
+			c.Webhook.Secret = "s"
+			c.Webhook.Path = "hook"
+		}, `webhook path "hook" must start with /`},
+		{"webhook cert without key", func(c *Config) {
+			c.Webhook.URL = "https://bot.example.com"
+			c.Webhook.Secret = "s"
+			c.Webhook.CertFile = "cert.pem"
+		}, "cert_file and key_file go together"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaults()
+			c.Token = "token"
+			c.Database.DSN = "postgres://localhost/osat"
+
+			test.modify(c)
+
+			err := c.Validate()
+
+			switch {
+			case test.problem == "" && err != nil:
+				t.Errorf("Validate() = %v, want no error", err)
+			case test.problem != "" && err == nil:
+				t.Errorf("Validate() succeeded, want %q", test.problem)
+			case test.problem != "" && !strings.Contains(err.Error(), test.problem):
+				t.Errorf("Validate() = %v, want %q", err, test.problem)
+			}
+		})
+	}
+}
+
+func TestValidateFillsDefaults(t *testing.T) {
+	c := defaults()
+	c.Token = "token"
+	c.Database = DatabaseConfig{Driver: DriverSQLite}
+	c.Webhook.URL = "https://bot.example.com/hook"
+	c.Webhook.Secret = "s"
+
+	err := c.Validate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Location == nil || c.Location.String() != "Asia/Krasnoyarsk" {
+		t.Errorf("location is %v", c.Location)
+	}
+
+	if c.ReminderHour != 4 || c.ReminderMinute != 30 {
+		t.Errorf("reminder time is %d:%d", c.ReminderHour, c.ReminderMinute)
+	}
+
+	if c.Database.DSN != "osat.sqlite" {
+		t.Errorf("sqlite dsn is %q", c.Database.DSN)
+	}
+
+	if c.Webhook.Path != "/hook" {
+		t.Errorf("webhook path is %q", c.Webhook.Path)
+	}
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gungniir/telegram-quezlet-bot/models"
+)
+
+func TestSweepConversations(t *testing.T) {
+	backends(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		now := time.Now().UTC().Truncate(time.Second)
+		keep := 30 * 24 * time.Hour
+
+		conversations := []*models.Conversation{
+			{UserID: 1, Status: 13, ExpiresAt: now.Add(-time.Hour)},                                     // Abandoned flow
+			{UserID: 2, Status: 0, ExpiresAt: now.Add(-time.Hour)},                                      // Idle
+			{UserID: 3, Status: 0, ExpiresAt: now.Add(-keep - time.Hour), Expired: true},                // Expired long ago
+			{UserID: 4, Status: 0, ExpiresAt: now.Add(-24 * time.Hour), Expired: true},                  // Expired, not told yet
+			{UserID: 5, Status: 13, ExpiresAt: now.Add(time.Hour), Values: map[string]string{"a": "b"}}, // Active flow
+		}
+
+		for _, conversation := range conversations {
+			err := db.SaveConversation(ctx, conversation)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expired, deleted, err := db.SweepConversations(ctx, now, keep)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expired != 1 || deleted != 2 {
+			t.Errorf("sweep expired %d and deleted %d, want 1 and 2", expired, deleted)
+		}
+
+		want := map[int]struct {
+			status  int
+			expired bool
+			stored  bool
+		}{
+			1: {0, true, true},
+			2: {0, false, false},
+			3: {0, false, false},
+			4: {0, true, true},
+			5: {13, false, true},
+		}
+
+		for userID, want := range want {
+			conversation, err := db.GetConversation(ctx, userID)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored := !conversation.ExpiresAt.IsZero()
+
+			if conversation.Status != want.status || conversation.Expired != want.expired || stored != want.stored {
+				t.Errorf("conversation of user %d is %+v", userID, conversation)
+			}
+		}
+
+		// The flow of the abandoned one is reset, the active one keeps its values
+		if conversation, _ := db.GetConversation(ctx, 1); len(conversation.Values) != 0 {
+			t.Errorf("abandoned conversation kept %v", conversation.Values)
+		}
+
+		if conversation, _ := db.GetConversation(ctx, 5); conversation.Values["a"] != "b" {
+			t.Errorf("active conversation lost its values: %v", conversation.Values)
+		}
+
+		expired, deleted, err = db.SweepConversations(ctx, now, keep)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expired != 0 || deleted != 0 {
+			t.Errorf("second sweep expired %d and deleted %d, want nothing", expired, deleted)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"github.com/gungniir/telegram-quezlet-bot/models"
+	"github.com/gungniir/telegram-quezlet-bot/scheduler"
 	"time"
 )
 
@@ -12,17 +13,72 @@ type Database interface {
 
 	GetDate(ctx context.Context) (*time.Time, error)
 
-	AddUserToGroup(ctx context.Context, userID, groupID int) error
+	// AddUserToGroup schedules the items of the group for the day after today, the user's local date
+	AddUserToGroup(ctx context.Context, userID, groupID int, today time.Time) error
 	RemoveUserFromGroup(ctx context.Context, userID, groupID int) error
 	GetUserGroups(ctx context.Context, userID int) ([]*models.Group, error)
 
+	GetItem(ctx context.Context, itemID int) (*models.Item, error)
 	GetItemsByGroupID(ctx context.Context, groupID int) ([]*models.Item, error)
-	GetTodayItems(ctx context.Context) ([]*models.Item, error)
-	CreateItem(ctx context.Context, groupID int, url, name string) (*models.Item, error)
-	ProlongByItemIDWithCheck(ctx context.Context, itemID, counter int) error
-	ProlongYesterdayItem(ctx context.Context) error
+	GetUserItemsByGroupID(ctx context.Context, userID, groupID int) ([]*models.Progress, error)
+	// GetTodayItems returns the user's items due on today, the user's local date. Mastered items are skipped.
+	GetTodayItems(ctx context.Context, userID int, today time.Time) ([]*models.Progress, error)
+	// CreateItem schedules the new item for every member for the day after today, the creator's local date
+	CreateItem(ctx context.Context, userID, groupID int, url, name string, today time.Time) (*models.Progress, error)
+	UpdateItem(ctx context.Context, item *models.Item) error
+	DeleteItem(ctx context.Context, itemID int) error
+	// ProlongByItemIDWithCheck records the review and returns nil progress if the version has already moved on
+	// or the item has graduated. The next repetition is counted from today, the user's local date.
+	ProlongByItemIDWithCheck(ctx context.Context, userID, itemID, version int, grade scheduler.Grade, today time.Time) (*models.Progress, error)
+	// ProlongYesterdayItem moves the user's overdue items to today, the user's local date. The date they
+	// first fell due is kept, so that a review counts as late however many times the item has been moved.
+	ProlongYesterdayItem(ctx context.Context, userID int, today time.Time) error
+	// ReviveItem puts a mastered item back into rotation from the day after today, nil if it was not mastered
+	ReviveItem(ctx context.Context, userID, itemID int, today time.Time) (*models.Progress, error)
+	// SnoozeByItemIDWithCheck moves the item to days after today without touching the counter, nil if the version has moved on
+	SnoozeByItemIDWithCheck(ctx context.Context, userID, itemID, version, days int, today time.Time) (*models.Progress, error)
 
+	GetReviewsByUserID(ctx context.Context, userID int) ([]*models.Review, error)
+	GetReviewsByGroupID(ctx context.Context, groupID int) ([]*models.Review, error)
+
+	GetUserSettings(ctx context.Context, userID int) (*models.UserSettings, error)
+	SetUserSettings(ctx context.Context, settings *models.UserSettings) error
+	// GetUserSettingsList returns settings of every user with a known chat, defaults included
+	GetUserSettingsList(ctx context.Context) ([]*models.UserSettings, error)
+
+	// ClaimReminder marks the user as reminded on day and puts the messages of the reminder into
+	// the outbox in the same transaction. False and nothing enqueued if they already were reminded.
+	ClaimReminder(ctx context.Context, userID int, day time.Time, messages []*models.OutboxMessage) (bool, error)
+
+	// EnqueueMessages puts the messages into the outbox at once, in order
+	EnqueueMessages(ctx context.Context, messages []*models.OutboxMessage) error
+	// GetDueMessages returns pending messages due by now in order, leaving out chats
+	// whose earlier message is waiting for a retry
+	GetDueMessages(ctx context.Context, now time.Time, limit int) ([]*models.OutboxMessage, error)
+	// UpdateMessage saves the status, attempts, next attempt and last error of the message
+	UpdateMessage(ctx context.Context, message *models.OutboxMessage) error
+
+	// GetConversation returns the user's conversation, an empty one if there is none
+	GetConversation(ctx context.Context, userID int) (*models.Conversation, error)
+	SaveConversation(ctx context.Context, conversation *models.Conversation) error
+	// SweepConversations resets the flows which expired by now and marks them expired. It deletes
+	// idle conversations once they expire and expired ones after keep on top.
+	SweepConversations(ctx context.Context, now time.Time, keep time.Duration) (expired, deleted int, err error)
+
+	// IsLeader tells whether this instance is the one to send reminders, it keeps
+	// the leadership once taken and takes it over when the old leader dies
+	IsLeader(ctx context.Context) (bool, error)
+
+	// SetChatIDByUserID links the user to the chat and makes the link active again
 	SetChatIDByUserID(ctx context.Context, chatID int64, userID int) error
+	// DeactivateChat stops messaging a chat which blocked the bot or is gone, until its user writes again
+	DeactivateChat(ctx context.Context, chatID int64) error
 	GetChatIDsByUserIDs(ctx context.Context, userIDs []int) (map[int]int64, error)
 	GetChatIDsByItemIDs(ctx context.Context, userIDs []int) (map[int][]int64, error)
 }
+
+var (
+	_ Database = (*Postgres)(nil)
+	_ Database = (*Memory)(nil)
+	_ Database = (*SQLite)(nil)
+)
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gungniir/telegram-quezlet-bot/models"
+	"github.com/gungniir/telegram-quezlet-bot/scheduler"
+)
+
+var today = time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+
+// backends runs test against every database which needs no server
+func backends(t *testing.T, test func(t *testing.T, db Database)) {
+	sched := scheduler.NewTable(scheduler.DefaultIntervals)
+
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemory(time.UTC, sched))
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := NewSQLite(filepath.Join(t.TempDir(), "test.sqlite"), time.UTC, sched)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test(t, db)
+	})
+}
+
+func TestProlongWithStaleVersion(t *testing.T) {
+	// Grades which leave the counter as it was, so that only the version tells a second tap
+	tests := []struct {
+		name  string
+		grade scheduler.Grade
+	}{
+		{"again", scheduler.GradeAgain},
+		{"hard", scheduler.GradeHard},
+		{"good", scheduler.GradeGood},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backends(t, func(t *testing.T, db Database) {
+				ctx := context.Background()
+				group, item := createItem(t, db)
+
+				progress, err := db.ProlongByItemIDWithCheck(ctx, 1, item.ID, item.Version, test.grade, today)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if progress == nil || progress.Version == item.Version || !progress.RepeatAt.Equal(today.AddDate(0, 0, 1)) {
+					t.Fatalf("first review gave %+v", progress)
+				}
+
+				// The same button pressed twice carries the old version
+				stale, err := db.ProlongByItemIDWithCheck(ctx, 1, item.ID, item.Version, test.grade, today)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if stale != nil {
+					t.Errorf("review with a stale version gave %+v", stale)
+				}
+
+				snoozed, err := db.SnoozeByItemIDWithCheck(ctx, 1, item.ID, item.Version, 3, today)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if snoozed != nil {
+					t.Errorf("snooze with a stale version gave %+v", snoozed)
+				}
+
+				reviews, err := db.GetReviewsByUserID(ctx, 1)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(reviews) != 1 {
+					t.Errorf("got %d reviews, want 1", len(reviews))
+				}
+
+				items, err := db.GetUserItemsByGroupID(ctx, 1, group.ID)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(items) != 1 || items[0].Version != progress.Version || !items[0].RepeatAt.Equal(*progress.RepeatAt) {
+					t.Errorf("stored progress is %+v, want %+v", items[0], progress)
+				}
+			})
+		})
+	}
+}
+
+func TestProlongMasteredItem(t *testing.T) {
+	backends(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+		_, item := createItem(t, db)
+
+		version := item.Version
+
+		for i := 0; ; i++ {
+			progress, err := db.ProlongByItemIDWithCheck(ctx, 1, item.ID, version, scheduler.GradeEasy, today)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if progress == nil {
+				t.Fatalf("review %d was rejected", i)
+			}
+
+			version = progress.Version
+
+			if progress.Mastered() {
+				break
+			}
+		}
+
+		// Even the button of the current version must not bring the item back
+		progress, err := db.ProlongByItemIDWithCheck(ctx, 1, item.ID, version, scheduler.GradeHard, today)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if progress != nil {
+			t.Errorf("review of a mastered item gave %+v", progress)
+		}
+
+		revived, err := db.ReviveItem(ctx, 1, item.ID, today)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if revived == nil || revived.Mastered() || revived.Version == version {
+			t.Errorf("revival gave %+v", revived)
+		}
+	})
+}
+
+// createItem creates a group of user 1 with an item due tomorrow
+func createItem(t *testing.T, db Database) (*models.Group, *models.Progress) {
+	ctx := context.Background()
+
+	group, err := db.CreateGroup(ctx, "hash")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddUserToGroup(ctx, 1, group.ID, today)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := db.CreateItem(ctx, 1, group.ID, "https://quizlet.com/1/words", "Words", today)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !item.RepeatAt.Equal(today.AddDate(0, 0, 1)) {
+		t.Errorf("new item repeats at %s, want the day after today", item.RepeatAt)
+	}
+
+	return group, item
+}
+
+func TestReviewOfRolledItemIsLate(t *testing.T) {
+	backends(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+
+		// Reviews are stamped with the real time, so the dates are counted from it
+		now := time.Now().UTC()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+		group, err := db.CreateGroup(ctx, "hash")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.AddUserToGroup(ctx, 1, group.ID, today)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Due two days ago
+		item, err := db.CreateItem(ctx, 1, group.ID, "https://quizlet.com/1/words", "Words", today.AddDate(0, 0, -3))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The reminder of every day moves the item on, as if it had been missed twice
+		for _, day := range []time.Time{today.AddDate(0, 0, -1), today} {
+			err = db.ProlongYesterdayItem(ctx, 1, day)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		items, err := db.GetTodayItems(ctx, 1, today)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(items) != 1 {
+			t.Fatalf("got %d items due today, want the rolled one", len(items))
+		}
+
+		_, err = db.ProlongByItemIDWithCheck(ctx, 1, item.ID, item.Version, scheduler.GradeGood, today)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reviews, err := db.GetReviewsByUserID(ctx, 1)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(reviews) != 1 {
+			t.Fatalf("got %d reviews, want 1", len(reviews))
+		}
+
+		if want := today.AddDate(0, 0, -2); !reviews[0].DueAt.Equal(want) {
+			t.Errorf("review is due at %s, want %s", reviews[0].DueAt, want)
+		}
+
+		if reviews[0].OnTime(time.UTC) {
+			t.Error("review of an item missed for two days is on time")
+		}
+	})
+}
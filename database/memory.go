@@ -0,0 +1,798 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/gungniir/telegram-quezlet-bot/models"
+	"github.com/gungniir/telegram-quezlet-bot/scheduler"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory keeps everything in process memory. It mirrors the behaviour of Postgres
+// and is meant for local runs and tests, all data is lost on exit.
+type Memory struct {
+	mu    sync.RWMutex
+	loc   *time.Location
+	now   func() time.Time
+	sched scheduler.Scheduler
+
+	groups   map[int]*models.Group
+	items    map[int]*models.Item
+	members  map[int]map[int]bool // group_id -> user_id
+	progress map[progressKey]*memoryProgress
+	chats    map[int]int64
+	reviews  []*models.Review
+	settings map[int]*models.UserSettings
+	reminded map[int]time.Time
+	inactive map[int]bool
+	outbox   []*models.OutboxMessage
+
+	conversations map[int]*models.Conversation
+
+	lastGroupID int
+	lastItemID  int
+}
+
+type progressKey struct {
+	userID int
+	itemID int
+}
+
+type memoryProgress struct {
+	repeatAt   time.Time
+	dueSince   *time.Time // Set while the item is overdue, repeatAt is moved to today then
+	counter    int
+	ease       float64
+	interval   int
+	version    int
+	masteredAt *time.Time
+}
+
+// NewMemory creates an empty database. A nil sched falls back to the table
+// schedule with the same intervals as the seed of the prolong table.
+func NewMemory(loc *time.Location, sched scheduler.Scheduler) *Memory {
+	if sched == nil {
+		sched = scheduler.NewTable(scheduler.DefaultIntervals)
+	}
+
+	return &Memory{
+		loc:      loc,
+		now:      time.Now,
+		sched:    sched,
+		groups:   make(map[int]*models.Group),
+		items:    make(map[int]*models.Item),
+		members:  make(map[int]map[int]bool),
+		progress: make(map[progressKey]*memoryProgress),
+		chats:    make(map[int]int64),
+		settings: make(map[int]*models.UserSettings),
+		reminded: make(map[int]time.Time),
+		inactive: make(map[int]bool),
+
+		conversations: make(map[int]*models.Conversation),
+	}
+}
+
+// today is the analogue of current_date: midnight of the local date, as pgx scans a date column
+func (m *Memory) today() time.Time {
+	now := m.now().In(m.loc)
+
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func (m *Memory) toModel(key progressKey, p *memoryProgress) *models.Progress {
+	item := *m.items[key.itemID]
+	repeatAt := p.repeatAt
+
+	var masteredAt *time.Time
+
+	if p.masteredAt != nil {
+		date := *p.masteredAt
+		masteredAt = &date
+	}
+
+	return &models.Progress{
+		Item:       &item,
+		UserID:     key.userID,
+		RepeatAt:   &repeatAt,
+		Counter:    p.counter,
+		Ease:       p.ease,
+		Interval:   p.interval,
+		Version:    p.version,
+		MasteredAt: masteredAt,
+	}
+}
+
+func (m *Memory) GetDate(_ context.Context) (*time.Time, error) {
+	today := m.today()
+
+	return &today, nil
+}
+
+func (m *Memory) CreateGroup(_ context.Context, passwordHash string) (*models.Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastGroupID++
+
+	group := &models.Group{
+		ID:           m.lastGroupID,
+		PasswordHash: passwordHash,
+	}
+
+	m.groups[group.ID] = group
+	m.members[group.ID] = make(map[int]bool)
+
+	copied := *group
+
+	return &copied, nil
+}
+
+func (m *Memory) GetGroup(_ context.Context, groupID int) (*models.Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	group, ok := m.groups[groupID]
+
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *group
+
+	return &copied, nil
+}
+
+func (m *Memory) AddUserToGroup(_ context.Context, userID, groupID int, today time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members, ok := m.members[groupID]
+
+	if !ok {
+		return fmt.Errorf("group %d does not exist", groupID)
+	}
+
+	if members[userID] {
+		return fmt.Errorf("user %d is already in group %d", userID, groupID)
+	}
+
+	members[userID] = true
+
+	for _, item := range m.items {
+		key := progressKey{userID: userID, itemID: item.ID}
+
+		if item.GroupID != groupID || m.progress[key] != nil {
+			continue
+		}
+
+		m.progress[key] = newProgress(today)
+	}
+
+	return nil
+}
+
+func (m *Memory) RemoveUserFromGroup(_ context.Context, userID, groupID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.members[groupID], userID)
+
+	for key := range m.progress {
+		if key.userID == userID && m.items[key.itemID].GroupID == groupID {
+			delete(m.progress, key)
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) GetUserGroups(_ context.Context, userID int) ([]*models.Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var groups []*models.Group
+
+	for groupID, members := range m.members {
+		if members[userID] {
+			copied := *m.groups[groupID]
+			groups = append(groups, &copied)
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+
+	return groups, nil
+}
+
+func (m *Memory) GetItem(_ context.Context, itemID int) (*models.Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	item, ok := m.items[itemID]
+
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *item
+
+	return &copied, nil
+}
+
+func (m *Memory) GetItemsByGroupID(_ context.Context, groupID int) ([]*models.Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := make([]*models.Item, 0)
+
+	for _, item := range m.items {
+		if item.GroupID == groupID {
+			copied := *item
+			items = append(items, &copied)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+
+	return items, nil
+}
+
+func (m *Memory) GetUserItemsByGroupID(_ context.Context, userID, groupID int) ([]*models.Progress, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := make([]*models.Progress, 0)
+
+	for key, p := range m.progress {
+		if key.userID == userID && m.items[key.itemID].GroupID == groupID {
+			items = append(items, m.toModel(key, p))
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].RepeatAt.Equal(*items[j].RepeatAt) {
+			return items[i].RepeatAt.Before(*items[j].RepeatAt)
+		}
+
+		return items[i].ID < items[j].ID
+	})
+
+	return items, nil
+}
+
+func (m *Memory) GetTodayItems(_ context.Context, userID int, today time.Time) ([]*models.Progress, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := make([]*models.Progress, 0)
+
+	for key, p := range m.progress {
+		if key.userID == userID && sameDate(p.repeatAt, today) && p.masteredAt == nil {
+			items = append(items, m.toModel(key, p))
+		}
+	}
+
+	sortProgress(items)
+
+	return items, nil
+}
+
+func (m *Memory) CreateItem(_ context.Context, userID, groupID int, url, name string, today time.Time) (*models.Progress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.groups[groupID] == nil {
+		return nil, fmt.Errorf("group %d does not exist", groupID)
+	}
+
+	if !m.members[groupID][userID] {
+		return nil, fmt.Errorf("user %d is not in group %d", userID, groupID)
+	}
+
+	m.lastItemID++
+
+	key := progressKey{userID: userID, itemID: m.lastItemID}
+
+	m.items[key.itemID] = &models.Item{
+		ID:      key.itemID,
+		GroupID: groupID,
+		URL:     url,
+		Name:    name,
+	}
+
+	for memberID := range m.members[groupID] {
+		m.progress[progressKey{userID: memberID, itemID: key.itemID}] = newProgress(today)
+	}
+
+	return m.toModel(key, m.progress[key]), nil
+}
+
+func (m *Memory) UpdateItem(_ context.Context, item *models.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.items[item.ID]
+
+	if !ok {
+		return nil
+	}
+
+	stored.URL = item.URL
+	stored.Name = item.Name
+
+	return nil
+}
+
+func (m *Memory) DeleteItem(_ context.Context, itemID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.items, itemID)
+
+	for key := range m.progress {
+		if key.itemID == itemID {
+			delete(m.progress, key)
+		}
+	}
+
+	return nil
+}
+
+// newProgress follows the column defaults of user_items, due the day after today
+func newProgress(today time.Time) *memoryProgress {
+	return &memoryProgress{
+		repeatAt: today.AddDate(0, 0, 1),
+		ease:     2.5,
+	}
+}
+
+func (m *Memory) ProlongByItemIDWithCheck(_ context.Context, userID, itemID, version int, grade scheduler.Grade, today time.Time) (*models.Progress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := progressKey{userID: userID, itemID: itemID}
+	p := m.progress[key]
+
+	if p == nil || p.version != version || p.masteredAt != nil {
+		return nil, nil
+	}
+
+	state, err := m.sched.Next(scheduler.State{Counter: p.counter, Ease: p.ease, Interval: p.interval}, grade)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dueAt := p.repeatAt
+
+	if p.dueSince != nil {
+		dueAt = *p.dueSince
+	}
+
+	m.reviews = append(m.reviews, &models.Review{
+		ID:         len(m.reviews) + 1,
+		UserID:     userID,
+		ItemID:     itemID,
+		GroupID:    m.items[itemID].GroupID,
+		OldCounter: p.counter,
+		NewCounter: state.Counter,
+		Grade:      grade,
+		DueAt:      &dueAt,
+		ReviewedAt: m.now(),
+	})
+
+	p.repeatAt = today.AddDate(0, 0, state.Interval)
+	p.dueSince = nil
+	p.counter = state.Counter
+	p.ease = state.Ease
+	p.interval = state.Interval
+	p.version++
+	p.masteredAt = nil
+
+	if state.Mastered {
+		masteredAt := today
+		p.masteredAt = &masteredAt
+	}
+
+	return m.toModel(key, p), nil
+}
+
+func (m *Memory) ProlongYesterdayItem(_ context.Context, userID int, today time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	date := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+
+	for key, p := range m.progress {
+		if key.userID == userID && p.repeatAt.Before(date) && p.masteredAt == nil {
+			if p.dueSince == nil {
+				dueSince := p.repeatAt
+				p.dueSince = &dueSince
+			}
+
+			p.repeatAt = date
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) SnoozeByItemIDWithCheck(_ context.Context, userID, itemID, version, days int, today time.Time) (*models.Progress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := progressKey{userID: userID, itemID: itemID}
+	p := m.progress[key]
+
+	if p == nil || p.version != version || p.masteredAt != nil {
+		return nil, nil
+	}
+
+	p.repeatAt = today.AddDate(0, 0, days)
+	p.dueSince = nil
+	p.version++
+
+	return m.toModel(key, p), nil
+}
+
+func (m *Memory) ReviveItem(_ context.Context, userID, itemID int, today time.Time) (*models.Progress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := progressKey{userID: userID, itemID: itemID}
+	p := m.progress[key]
+
+	if p == nil || p.masteredAt == nil {
+		return nil, nil
+	}
+
+	m.progress[key] = newProgress(today)
+	m.progress[key].version = p.version + 1
+
+	return m.toModel(key, m.progress[key]), nil
+}
+
+func (m *Memory) GetReviewsByUserID(_ context.Context, userID int) ([]*models.Review, error) {
+	return m.filterReviews(func(review *models.Review) bool {
+		return review.UserID == userID
+	}), nil
+}
+
+func (m *Memory) GetReviewsByGroupID(_ context.Context, groupID int) ([]*models.Review, error) {
+	return m.filterReviews(func(review *models.Review) bool {
+		return review.GroupID == groupID
+	}), nil
+}
+
+func (m *Memory) filterReviews(match func(review *models.Review) bool) []*models.Review {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	reviews := make([]*models.Review, 0)
+
+	for _, review := range m.reviews {
+		if match(review) {
+			copied := *review
+			reviews = append(reviews, &copied)
+		}
+	}
+
+	return reviews
+}
+
+func (m *Memory) GetUserSettings(_ context.Context, userID int) (*models.UserSettings, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.userSettings(userID), nil
+}
+
+func (m *Memory) SetUserSettings(_ context.Context, settings *models.UserSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *settings
+
+	if settings.RemindAt != nil {
+		remindAt := *settings.RemindAt
+		copied.RemindAt = &remindAt
+	}
+
+	m.settings[settings.UserID] = &copied
+
+	return nil
+}
+
+func (m *Memory) GetUserSettingsList(_ context.Context) ([]*models.UserSettings, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]*models.UserSettings, 0, len(m.chats))
+
+	for userID := range m.chats {
+		if m.inactive[userID] {
+			continue
+		}
+
+		settings := m.userSettings(userID)
+
+		if remindedOn, ok := m.reminded[userID]; ok {
+			settings.RemindedOn = &remindedOn
+		}
+
+		list = append(list, settings)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UserID < list[j].UserID
+	})
+
+	return list, nil
+}
+
+func (m *Memory) ClaimReminder(_ context.Context, userID int, day time.Time, messages []*models.OutboxMessage) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if remindedOn, ok := m.reminded[userID]; ok && !remindedOn.Before(day) {
+		return false, nil
+	}
+
+	m.reminded[userID] = day
+	m.enqueue(messages)
+
+	return true, nil
+}
+
+func (m *Memory) userSettings(userID int) *models.UserSettings {
+	settings := &models.UserSettings{UserID: userID}
+
+	if stored, ok := m.settings[userID]; ok {
+		settings.Timezone = stored.Timezone
+
+		if stored.RemindAt != nil {
+			remindAt := *stored.RemindAt
+			settings.RemindAt = &remindAt
+		}
+	}
+
+	return settings
+}
+
+func (m *Memory) EnqueueMessages(_ context.Context, messages []*models.OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.enqueue(messages)
+
+	return nil
+}
+
+// enqueue is EnqueueMessages under the lock
+func (m *Memory) enqueue(messages []*models.OutboxMessage) {
+	for _, message := range messages {
+		message.ID = len(m.outbox) + 1
+		message.Status = models.OutboxPending
+		message.Attempts = 0
+		message.NextAttemptAt = m.now()
+
+		copied := *message
+		m.outbox = append(m.outbox, &copied)
+	}
+}
+
+func (m *Memory) GetDueMessages(_ context.Context, now time.Time, limit int) ([]*models.OutboxMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	messages := make([]*models.OutboxMessage, 0)
+	waiting := make(map[int64]bool)
+
+	for _, message := range m.outbox {
+		if len(messages) == limit {
+			break
+		}
+
+		if message.Status != models.OutboxPending || waiting[message.ChatID] {
+			continue
+		}
+
+		if message.NextAttemptAt.After(now) {
+			waiting[message.ChatID] = true
+			continue
+		}
+
+		copied := *message
+		messages = append(messages, &copied)
+	}
+
+	return messages, nil
+}
+
+func (m *Memory) UpdateMessage(_ context.Context, message *models.OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if message.ID < 1 || message.ID > len(m.outbox) {
+		return fmt.Errorf("message %d does not exist", message.ID)
+	}
+
+	stored := m.outbox[message.ID-1]
+	stored.Status = message.Status
+	stored.Attempts = message.Attempts
+	stored.NextAttemptAt = message.NextAttemptAt
+	stored.LastError = message.LastError
+
+	return nil
+}
+
+func (m *Memory) GetConversation(_ context.Context, userID int) (*models.Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	conversation := &models.Conversation{UserID: userID, Values: make(map[string]string)}
+
+	if stored, ok := m.conversations[userID]; ok {
+		conversation.Status = stored.Status
+		conversation.UpdatedAt = stored.UpdatedAt
+		conversation.ExpiresAt = stored.ExpiresAt
+		conversation.Expired = stored.Expired
+
+		for key, value := range stored.Values {
+			conversation.Values[key] = value
+		}
+	}
+
+	return conversation, nil
+}
+
+func (m *Memory) SaveConversation(_ context.Context, conversation *models.Conversation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conversation.UpdatedAt = m.now()
+
+	stored := &models.Conversation{
+		UserID:    conversation.UserID,
+		Status:    conversation.Status,
+		Values:    make(map[string]string, len(conversation.Values)),
+		UpdatedAt: conversation.UpdatedAt,
+		ExpiresAt: conversation.ExpiresAt,
+		Expired:   conversation.Expired,
+	}
+
+	for key, value := range conversation.Values {
+		stored.Values[key] = value
+	}
+
+	m.conversations[conversation.UserID] = stored
+
+	return nil
+}
+
+func (m *Memory) SweepConversations(_ context.Context, now time.Time, keep time.Duration) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expired, deleted := 0, 0
+
+	for userID, conversation := range m.conversations {
+		if conversation.ExpiresAt.After(now) {
+			continue
+		}
+
+		switch {
+		case conversation.Status != 0 && !conversation.Expired:
+			conversation.Status = 0
+			conversation.Values = make(map[string]string)
+			conversation.Expired = true
+			expired++
+		case !conversation.Expired, !conversation.ExpiresAt.After(now.Add(-keep)):
+			delete(m.conversations, userID)
+			deleted++
+		}
+	}
+
+	return expired, deleted, nil
+}
+
+// IsLeader is always true, nothing is shared with other instances
+func (m *Memory) IsLeader(_ context.Context) (bool, error) {
+	return true, nil
+}
+
+func (m *Memory) SetChatIDByUserID(_ context.Context, chatID int64, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.chats[userID] = chatID
+	delete(m.inactive, userID)
+
+	return nil
+}
+
+func (m *Memory) DeactivateChat(_ context.Context, chatID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for userID, userChatID := range m.chats {
+		if userChatID == chatID {
+			m.inactive[userID] = true
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) GetChatIDsByUserIDs(_ context.Context, userIDs []int) (map[int]int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make(map[int]int64, len(userIDs))
+
+	for _, userID := range userIDs {
+		if chatID, ok := m.chats[userID]; ok && !m.inactive[userID] {
+			ids[userID] = chatID
+		}
+	}
+
+	return ids, nil
+}
+
+// GetChatIDsByItemIDs fans an item out to the chats of all members of its group, as the item_chats view does
+func (m *Memory) GetChatIDsByItemIDs(_ context.Context, itemIDs []int) (map[int][]int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := make(map[int][]int64)
+
+	for _, itemID := range itemIDs {
+		item, ok := m.items[itemID]
+
+		if !ok {
+			continue
+		}
+
+		userIDs := make([]int, 0, len(m.members[item.GroupID]))
+
+		for userID := range m.members[item.GroupID] {
+			userIDs = append(userIDs, userID)
+		}
+
+		sort.Ints(userIDs)
+
+		for _, userID := range userIDs {
+			if chatID, ok := m.chats[userID]; ok && !m.inactive[userID] {
+				items[itemID] = append(items[itemID], chatID)
+			}
+		}
+	}
+
+	return items, nil
+}
+
+func sameDate(a, b time.Time) bool {
+	return a.Year() == b.Year() && a.Month() == b.Month() && a.Day() == b.Day()
+}
+
+func sortProgress(items []*models.Progress) {
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+
+		if a.GroupID != b.GroupID {
+			return a.GroupID < b.GroupID
+		}
+
+		return a.ID < b.ID
+	})
+}
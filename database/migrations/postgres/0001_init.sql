@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS groups
+(
+    id            serial PRIMARY KEY,
+    password_hash text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS items
+(
+    id        serial PRIMARY KEY,
+    url       varchar(512) NOT NULL,
+    name      varchar(128) NOT NULL,
+    group_id  integer      NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+    repeat_at date                  DEFAULT current_date + 1,
+    counter   integer      NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS groups_users_links
+(
+    user_id  integer NOT NULL,
+    group_id integer NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, group_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_chat_links
+(
+    user_id integer PRIMARY KEY,
+    chat_id bigint NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS prolong
+(
+    count integer PRIMARY KEY,
+    add   integer NOT NULL
+);
+
+CREATE OR REPLACE VIEW item_chats AS
+SELECT i.id, array_agg(ucl.chat_id) AS chat_ids
+FROM items i
+         INNER JOIN groups_users_links gul ON gul.group_id = i.group_id
+         INNER JOIN user_chat_links ucl ON ucl.user_id = gul.user_id
+GROUP BY i.id;
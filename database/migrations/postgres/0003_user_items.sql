@@ -0,0 +1,19 @@
+CREATE TABLE user_items
+(
+    user_id   integer NOT NULL,
+    item_id   integer NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+    repeat_at date    NOT NULL DEFAULT current_date + 1,
+    counter   integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, item_id)
+);
+
+CREATE INDEX user_items_repeat_at_idx ON user_items (repeat_at);
+
+INSERT INTO user_items(user_id, item_id, repeat_at, counter)
+SELECT gul.user_id, i.id, coalesce(i.repeat_at, current_date), i.counter
+FROM items i
+         INNER JOIN groups_users_links gul ON gul.group_id = i.group_id;
+
+ALTER TABLE items
+    DROP COLUMN repeat_at,
+    DROP COLUMN counter;
@@ -0,0 +1,9 @@
+ALTER TABLE user_items
+    ADD COLUMN ease          double precision NOT NULL DEFAULT 2.5,
+    ADD COLUMN interval_days integer          NOT NULL DEFAULT 0;
+
+-- Restore the last interval of already reviewed items from the table schedule
+UPDATE user_items ui
+SET interval_days = p.add
+FROM prolong p
+WHERE p.count = ui.counter - 1;
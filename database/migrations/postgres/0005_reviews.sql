@@ -0,0 +1,16 @@
+-- No foreign key on item_id: the history outlives the items
+CREATE TABLE reviews
+(
+    id          serial PRIMARY KEY,
+    user_id     integer     NOT NULL,
+    item_id     integer     NOT NULL,
+    group_id    integer     NOT NULL,
+    old_counter integer     NOT NULL,
+    new_counter integer     NOT NULL,
+    grade       integer     NOT NULL,
+    due_at      date        NOT NULL,
+    reviewed_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX reviews_user_id_idx ON reviews (user_id);
+CREATE INDEX reviews_group_id_idx ON reviews (group_id);
@@ -0,0 +1,6 @@
+CREATE TABLE user_settings
+(
+    user_id   integer PRIMARY KEY,
+    timezone  text,
+    remind_at integer CHECK (remind_at >= 0 AND remind_at < 24 * 60)
+);
@@ -0,0 +1,5 @@
+CREATE TABLE reminders
+(
+    user_id     integer PRIMARY KEY,
+    reminded_on date NOT NULL
+);
@@ -0,0 +1,17 @@
+CREATE TABLE outbox
+(
+    id              serial PRIMARY KEY,
+    chat_id         bigint      NOT NULL,
+    text            text        NOT NULL,
+    parse_mode      text        NOT NULL DEFAULT '',
+    keyboard        text        NOT NULL DEFAULT '',
+    silent          boolean     NOT NULL DEFAULT false,
+    status          text        NOT NULL DEFAULT 'pending',
+    attempts        integer     NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL DEFAULT now(),
+    last_error      text        NOT NULL DEFAULT '',
+    created_at      timestamptz NOT NULL DEFAULT now(),
+    finished_at     timestamptz
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (chat_id, id) WHERE status = 'pending';
@@ -0,0 +1,11 @@
+-- Chats which blocked the bot or disappeared are kept, but not messaged
+ALTER TABLE user_chat_links
+    ADD COLUMN active boolean NOT NULL DEFAULT true;
+
+CREATE OR REPLACE VIEW item_chats AS
+SELECT i.id, array_agg(ucl.chat_id) AS chat_ids
+FROM items i
+         INNER JOIN groups_users_links gul ON gul.group_id = i.group_id
+         INNER JOIN user_chat_links ucl ON ucl.user_id = gul.user_id
+WHERE ucl.active
+GROUP BY i.id;
@@ -0,0 +1,7 @@
+CREATE TABLE conversations
+(
+    user_id    integer PRIMARY KEY,
+    status     integer     NOT NULL DEFAULT 0,
+    data       jsonb       NOT NULL DEFAULT '{}',
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,9 @@
+-- Abandoned flows expire, expired marks them until the user is told about it
+ALTER TABLE conversations
+    ADD COLUMN expires_at timestamptz NOT NULL DEFAULT now() + interval '1 day',
+    ADD COLUMN expired    boolean     NOT NULL DEFAULT false;
+
+UPDATE conversations
+SET expires_at = updated_at + interval '1 day';
+
+CREATE INDEX conversations_expires_at_idx ON conversations (expires_at);
@@ -0,0 +1,4 @@
+-- The date an overdue item first fell due. The daily roll-forward moves repeat_at
+-- to today, so without it a late review would look like one on time.
+ALTER TABLE user_items
+    ADD COLUMN due_since date;
@@ -0,0 +1,7 @@
+-- Changes on every review, snooze and revival, the buttons carry it to tell a stale tap.
+-- The counter is what the buttons carried before, so the ones already sent keep working.
+ALTER TABLE user_items
+    ADD COLUMN version integer NOT NULL DEFAULT 0;
+
+UPDATE user_items
+SET version = counter;
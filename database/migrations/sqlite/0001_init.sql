@@ -0,0 +1,51 @@
+CREATE TABLE groups
+(
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    password_hash TEXT NOT NULL
+);
+
+CREATE TABLE items
+(
+    id       INTEGER PRIMARY KEY AUTOINCREMENT,
+    url      TEXT    NOT NULL,
+    name     TEXT    NOT NULL,
+    group_id INTEGER NOT NULL REFERENCES groups (id) ON DELETE CASCADE
+);
+
+CREATE TABLE groups_users_links
+(
+    user_id  INTEGER NOT NULL,
+    group_id INTEGER NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, group_id)
+);
+
+CREATE TABLE user_chat_links
+(
+    user_id INTEGER PRIMARY KEY,
+    chat_id INTEGER NOT NULL
+);
+
+CREATE TABLE prolong
+(
+    count INTEGER PRIMARY KEY,
+    "add" INTEGER NOT NULL
+);
+
+-- Dates are stored as YYYY-MM-DD text, the current date is always passed by the application
+CREATE TABLE user_items
+(
+    user_id   INTEGER NOT NULL,
+    item_id   INTEGER NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+    repeat_at TEXT    NOT NULL,
+    counter   INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, item_id)
+);
+
+CREATE INDEX user_items_repeat_at_idx ON user_items (repeat_at);
+
+-- SQLite has no arrays, so unlike Postgres the view has a row per chat
+CREATE VIEW item_chats AS
+SELECT i.id, ucl.chat_id
+FROM items i
+         INNER JOIN groups_users_links gul ON gul.group_id = i.group_id
+         INNER JOIN user_chat_links ucl ON ucl.user_id = gul.user_id;
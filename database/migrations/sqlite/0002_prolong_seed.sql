@@ -0,0 +1,10 @@
+INSERT INTO prolong(count, "add")
+VALUES (0, 1),
+       (1, 2),
+       (2, 4),
+       (3, 7),
+       (4, 14),
+       (5, 30),
+       (6, 60),
+       (7, 120)
+ON CONFLICT (count) DO NOTHING;
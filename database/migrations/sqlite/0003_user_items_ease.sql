@@ -0,0 +1,5 @@
+ALTER TABLE user_items
+    ADD COLUMN ease REAL NOT NULL DEFAULT 2.5;
+
+ALTER TABLE user_items
+    ADD COLUMN interval_days INTEGER NOT NULL DEFAULT 0;
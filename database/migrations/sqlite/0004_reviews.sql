@@ -0,0 +1,17 @@
+-- No foreign key on item_id: the history outlives the items.
+-- reviewed_at is an RFC 3339 UTC timestamp passed by the application.
+CREATE TABLE reviews
+(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id     INTEGER NOT NULL,
+    item_id     INTEGER NOT NULL,
+    group_id    INTEGER NOT NULL,
+    old_counter INTEGER NOT NULL,
+    new_counter INTEGER NOT NULL,
+    grade       INTEGER NOT NULL,
+    due_at      TEXT    NOT NULL,
+    reviewed_at TEXT    NOT NULL
+);
+
+CREATE INDEX reviews_user_id_idx ON reviews (user_id);
+CREATE INDEX reviews_group_id_idx ON reviews (group_id);
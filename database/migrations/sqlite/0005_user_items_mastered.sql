@@ -0,0 +1,2 @@
+ALTER TABLE user_items
+    ADD COLUMN mastered_at TEXT;
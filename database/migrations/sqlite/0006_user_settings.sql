@@ -0,0 +1,6 @@
+CREATE TABLE user_settings
+(
+    user_id   INTEGER PRIMARY KEY,
+    timezone  TEXT,
+    remind_at INTEGER CHECK (remind_at >= 0 AND remind_at < 24 * 60)
+);
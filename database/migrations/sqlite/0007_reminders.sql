@@ -0,0 +1,5 @@
+CREATE TABLE reminders
+(
+    user_id     INTEGER PRIMARY KEY,
+    reminded_on TEXT NOT NULL
+);
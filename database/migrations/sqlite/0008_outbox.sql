@@ -0,0 +1,18 @@
+-- Timestamps are RFC 3339 UTC strings passed by the application.
+CREATE TABLE outbox
+(
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    chat_id         INTEGER NOT NULL,
+    text            TEXT    NOT NULL,
+    parse_mode      TEXT    NOT NULL DEFAULT '',
+    keyboard        TEXT    NOT NULL DEFAULT '',
+    silent          INTEGER NOT NULL DEFAULT 0,
+    status          TEXT    NOT NULL DEFAULT 'pending',
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TEXT    NOT NULL,
+    last_error      TEXT    NOT NULL DEFAULT '',
+    created_at      TEXT    NOT NULL,
+    finished_at     TEXT
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (chat_id, id) WHERE status = 'pending';
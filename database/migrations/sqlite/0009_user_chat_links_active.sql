@@ -0,0 +1,12 @@
+-- Chats which blocked the bot or disappeared are kept, but not messaged
+ALTER TABLE user_chat_links
+    ADD COLUMN active INTEGER NOT NULL DEFAULT 1;
+
+DROP VIEW item_chats;
+
+CREATE VIEW item_chats AS
+SELECT i.id, ucl.chat_id
+FROM items i
+         INNER JOIN groups_users_links gul ON gul.group_id = i.group_id
+         INNER JOIN user_chat_links ucl ON ucl.user_id = gul.user_id
+WHERE ucl.active;
@@ -0,0 +1,8 @@
+-- data is a JSON object, updated_at an RFC 3339 UTC timestamp passed by the application.
+CREATE TABLE conversations
+(
+    user_id    INTEGER PRIMARY KEY,
+    status     INTEGER NOT NULL DEFAULT 0,
+    data       TEXT    NOT NULL DEFAULT '{}',
+    updated_at TEXT    NOT NULL
+);
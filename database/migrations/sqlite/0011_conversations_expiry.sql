@@ -0,0 +1,11 @@
+-- Abandoned flows expire, expired marks them until the user is told about it
+ALTER TABLE conversations
+    ADD COLUMN expires_at TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE conversations
+    ADD COLUMN expired INTEGER NOT NULL DEFAULT 0;
+
+UPDATE conversations
+SET expires_at = strftime('%Y-%m-%dT%H:%M:%SZ', updated_at, '+1 day');
+
+CREATE INDEX conversations_expires_at_idx ON conversations (expires_at);
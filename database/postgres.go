@@ -4,36 +4,175 @@ import (
 	"context"
 	"fmt"
 	"github.com/gungniir/telegram-quezlet-bot/models"
+	"github.com/gungniir/telegram-quezlet-bot/scheduler"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
+	"sync"
 	"time"
 )
 
 type Postgres struct {
-	pool *pgxpool.Pool
-	loc  int
+	pool  *pgxpool.Pool
+	loc   *time.Location
+	sched scheduler.Scheduler
+
+	leaderMu sync.Mutex
+	leader   *pgxpool.Conn // Holds the leader lock while this instance is the leader
 }
 
-func NewPostgres(connString string, loc int) (*Postgres, error) {
-	conn, err := pgxpool.Connect(context.Background(), connString)
+// NewPostgres connects to the database and migrates it. A nil sched falls back
+// to the table schedule from the prolong table.
+func NewPostgres(connString string, loc *time.Location, sched scheduler.Scheduler) (*Postgres, error) {
+	config, err := pgxpool.ParseConfig(connString)
 
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = conn.Exec(context.Background(), fmt.Sprintf(`SET TIME ZONE %d`, loc))
+	// Every pooled connection has to agree on current_date, so the time zone
+	// goes to the startup parameters instead of a one-off SET
+	config.ConnConfig.RuntimeParams["timezone"] = loc.String()
+
+	conn, err := pgxpool.ConnectConfig(context.Background(), config)
 
 	if err != nil {
 		return nil, err
 	}
 
 	p := &Postgres{
-		pool: conn,
-		loc:  loc,
+		pool:  conn,
+		loc:   loc,
+		sched: sched,
+	}
+
+	err = p.migrate(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.sched == nil {
+		intervals, err := p.getProlong(context.Background())
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.sched = scheduler.NewTable(intervals)
 	}
 
 	return p, nil
 }
 
+func (p *Postgres) getProlong(ctx context.Context) (map[int]int, error) {
+	pool := p.pool
+
+	rows, err := pool.Query(ctx, `SELECT count, add FROM prolong`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	intervals := make(map[int]int)
+
+	for rows.Next() {
+		var count, add int
+
+		err = rows.Scan(&count, &add)
+
+		if err != nil {
+			return nil, err
+		}
+
+		intervals[count] = add
+	}
+
+	return intervals, rows.Err()
+}
+
+// Arbitrary key of the advisory lock which keeps replicas from migrating simultaneously
+const migrationLockID = 7_250_001
+
+// Arbitrary key of the advisory lock held by the replica which sends reminders
+const leaderLockID = 7_250_002
+
+func (p *Postgres) migrate(ctx context.Context) error {
+	migrations, err := loadMigrations("postgres")
+
+	if err != nil {
+		return err
+	}
+
+	conn, err := p.pool.Acquire(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Exec(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(version integer PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now())`)
+
+	if err != nil {
+		return err
+	}
+
+	var current int
+
+	err = conn.QueryRow(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&current)
+
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := conn.Begin(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, m.sql)
+
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+
+		_, err = tx.Exec(ctx, `INSERT INTO schema_migrations(version, name) VALUES ($1, $2)`, m.version, m.name)
+
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+
+		err = tx.Commit(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Applied migration %s", m.name)
+	}
+
+	return nil
+}
+
 func (p *Postgres) GetDate(ctx context.Context) (*time.Time, error) {
 	pool := p.pool
 
@@ -78,12 +217,30 @@ func (p *Postgres) CreateGroup(ctx context.Context, passwordHash string) (*model
 	return group, nil
 }
 
-func (p *Postgres) AddUserToGroup(ctx context.Context, userID, groupID int) error {
+func (p *Postgres) AddUserToGroup(ctx context.Context, userID, groupID int, today time.Time) error {
 	pool := p.pool
 
-	_, err := pool.Exec(ctx, `INSERT INTO groups_users_links(user_id, group_id) VALUES ($1, $2)`, userID, groupID)
+	tx, err := pool.Begin(ctx)
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `INSERT INTO groups_users_links(user_id, group_id) VALUES ($1, $2)`, userID, groupID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO user_items(user_id, item_id, repeat_at) SELECT $1, id, $3::date + 1 FROM items WHERE group_id = $2 ON CONFLICT DO NOTHING`, userID, groupID, today)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
 func (p *Postgres) GetUserGroups(ctx context.Context, userID int) ([]*models.Group, error) {
@@ -116,9 +273,27 @@ func (p *Postgres) GetUserGroups(ctx context.Context, userID int) ([]*models.Gro
 func (p *Postgres) RemoveUserFromGroup(ctx context.Context, userID, groupID int) error {
 	pool := p.pool
 
-	_, err := pool.Exec(ctx, `DELETE FROM groups_users_links WHERE user_id = $1 AND group_id = $2`, userID, groupID)
+	tx, err := pool.Begin(ctx)
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM groups_users_links WHERE user_id = $1 AND group_id = $2`, userID, groupID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM user_items WHERE user_id = $1 AND item_id IN (SELECT id FROM items WHERE group_id = $2)`, userID, groupID)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
 func (p *Postgres) GetGroup(ctx context.Context, groupID int) (*models.Group, error) {
@@ -147,10 +322,36 @@ func (p *Postgres) GetGroup(ctx context.Context, groupID int) (*models.Group, er
 	return group, nil
 }
 
+func (p *Postgres) GetItem(ctx context.Context, itemID int) (*models.Item, error) {
+	pool := p.pool
+
+	rows, err := pool.Query(ctx, `SELECT id, url, name, group_id FROM items WHERE id = $1`, itemID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	item := &models.Item{}
+
+	err = rows.Scan(&item.ID, &item.URL, &item.Name, &item.GroupID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
 func (p *Postgres) GetItemsByGroupID(ctx context.Context, groupID int) ([]*models.Item, error) {
 	pool := p.pool
 
-	rows, err := pool.Query(ctx, `SELECT * FROM items WHERE group_id = $1 ORDER BY repeat_at`, groupID)
+	rows, err := pool.Query(ctx, `SELECT id, url, name, group_id FROM items WHERE group_id = $1 ORDER BY id`, groupID)
 
 	if err != nil {
 		return nil, err
@@ -163,7 +364,7 @@ func (p *Postgres) GetItemsByGroupID(ctx context.Context, groupID int) ([]*model
 	for rows.Next() {
 		item := &models.Item{}
 
-		err = rows.Scan(&item.ID, &item.URL, &item.Name, &item.GroupID, &item.RepeatAt, &item.Counter)
+		err = rows.Scan(&item.ID, &item.URL, &item.Name, &item.GroupID)
 
 		if err != nil {
 			return nil, err
@@ -175,10 +376,10 @@ func (p *Postgres) GetItemsByGroupID(ctx context.Context, groupID int) ([]*model
 	return items, nil
 }
 
-func (p *Postgres) CreateItem(ctx context.Context, groupID int, url, name string) (*models.Item, error) {
+func (p *Postgres) GetUserItemsByGroupID(ctx context.Context, userID, groupID int) ([]*models.Progress, error) {
 	pool := p.pool
 
-	rows, err := pool.Query(ctx, `INSERT INTO items(url, name, group_id) VALUES ($2, $3, $1) RETURNING *`, groupID, url, name)
+	rows, err := pool.Query(ctx, progressSelect+` WHERE ui.user_id = $1 AND i.group_id = $2 ORDER BY ui.repeat_at, i.id`, userID, groupID)
 
 	if err != nil {
 		return nil, err
@@ -186,23 +387,349 @@ func (p *Postgres) CreateItem(ctx context.Context, groupID int, url, name string
 
 	defer rows.Close()
 
-	rows.Next()
+	return scanProgress(rows)
+}
+
+func (p *Postgres) CreateItem(ctx context.Context, userID, groupID int, url, name string, today time.Time) (*models.Progress, error) {
+	pool := p.pool
+
+	tx, err := pool.Begin(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback(ctx)
 
 	item := &models.Item{}
 
-	err = rows.Scan(&item.ID, &item.URL, &item.Name, &item.GroupID, &item.RepeatAt, &item.Counter)
+	err = tx.QueryRow(ctx, `INSERT INTO items(url, name, group_id) VALUES ($2, $3, $1) RETURNING id, url, name, group_id`, groupID, url, name).
+		Scan(&item.ID, &item.URL, &item.Name, &item.GroupID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return item, nil
+	// Every member of the group gets their own schedule for the new item
+	_, err = tx.Exec(ctx, `INSERT INTO user_items(user_id, item_id, repeat_at) SELECT user_id, $1, $3::date + 1 FROM groups_users_links WHERE group_id = $2`, item.ID, groupID, today)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, progressSelect+` WHERE ui.user_id = $1 AND ui.item_id = $2`, userID, item.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := scanProgress(rows)
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("user %d is not in group %d", userID, groupID)
+	}
+
+	return items[0], tx.Commit(ctx)
+}
+
+func (p *Postgres) UpdateItem(ctx context.Context, item *models.Item) error {
+	pool := p.pool
+
+	_, err := pool.Exec(ctx, `UPDATE items SET url = $2, name = $3 WHERE id = $1`, item.ID, item.URL, item.Name)
+
+	return err
+}
+
+func (p *Postgres) DeleteItem(ctx context.Context, itemID int) error {
+	pool := p.pool
+
+	_, err := pool.Exec(ctx, `DELETE FROM items WHERE id = $1`, itemID)
+
+	return err
+}
+
+func (p *Postgres) GetUserSettings(ctx context.Context, userID int) (*models.UserSettings, error) {
+	pool := p.pool
+
+	settings := &models.UserSettings{UserID: userID}
+
+	err := pool.QueryRow(ctx, `SELECT coalesce(timezone, ''), remind_at FROM user_settings WHERE user_id = $1`, userID).
+		Scan(&settings.Timezone, &settings.RemindAt)
+
+	if err == pgx.ErrNoRows {
+		return settings, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func (p *Postgres) SetUserSettings(ctx context.Context, settings *models.UserSettings) error {
+	pool := p.pool
+
+	_, err := pool.Exec(ctx, `INSERT INTO user_settings(user_id, timezone, remind_at) VALUES ($1, nullif($2, ''), $3) ON CONFLICT (user_id) DO UPDATE SET timezone = excluded.timezone, remind_at = excluded.remind_at`,
+		settings.UserID, settings.Timezone, settings.RemindAt)
+
+	return err
+}
+
+func (p *Postgres) GetUserSettingsList(ctx context.Context) ([]*models.UserSettings, error) {
+	pool := p.pool
+
+	rows, err := pool.Query(ctx, `SELECT ucl.user_id, coalesce(us.timezone, ''), us.remind_at, r.reminded_on FROM user_chat_links ucl `+
+		`LEFT JOIN user_settings us ON us.user_id = ucl.user_id LEFT JOIN reminders r ON r.user_id = ucl.user_id WHERE ucl.active ORDER BY ucl.user_id`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	list := make([]*models.UserSettings, 0)
+
+	for rows.Next() {
+		settings := &models.UserSettings{}
+
+		err = rows.Scan(&settings.UserID, &settings.Timezone, &settings.RemindAt, &settings.RemindedOn)
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, settings)
+	}
+
+	return list, rows.Err()
+}
+
+func (p *Postgres) ClaimReminder(ctx context.Context, userID int, day time.Time, messages []*models.OutboxMessage) (bool, error) {
+	pool := p.pool
+
+	tx, err := pool.Begin(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `INSERT INTO reminders(user_id, reminded_on) VALUES ($1, $2) `+
+		`ON CONFLICT (user_id) DO UPDATE SET reminded_on = excluded.reminded_on WHERE reminders.reminded_on < excluded.reminded_on`,
+		userID, day)
+
+	if err != nil || tag.RowsAffected() == 0 {
+		return false, err
+	}
+
+	err = enqueue(ctx, tx, messages)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+func (p *Postgres) EnqueueMessages(ctx context.Context, messages []*models.OutboxMessage) error {
+	pool := p.pool
+
+	tx, err := pool.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	err = enqueue(ctx, tx, messages)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func enqueue(ctx context.Context, tx pgx.Tx, messages []*models.OutboxMessage) error {
+	for _, message := range messages {
+		err := tx.QueryRow(ctx, `INSERT INTO outbox(chat_id, text, parse_mode, keyboard, silent) VALUES ($1, $2, $3, $4, $5) RETURNING id, status, attempts, next_attempt_at`,
+			message.ChatID, message.Text, message.ParseMode, message.Keyboard, message.Silent).
+			Scan(&message.ID, &message.Status, &message.Attempts, &message.NextAttemptAt)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Postgres) GetDueMessages(ctx context.Context, now time.Time, limit int) ([]*models.OutboxMessage, error) {
+	pool := p.pool
+
+	rows, err := pool.Query(ctx, `SELECT id, chat_id, text, parse_mode, keyboard, silent, status, attempts, next_attempt_at, last_error FROM outbox o `+
+		`WHERE status = 'pending' AND next_attempt_at <= $1 `+
+		`AND NOT EXISTS (SELECT 1 FROM outbox w WHERE w.chat_id = o.chat_id AND w.status = 'pending' AND w.id < o.id AND w.next_attempt_at > $1) `+
+		`ORDER BY id LIMIT $2`, now, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	messages := make([]*models.OutboxMessage, 0)
+
+	for rows.Next() {
+		message := &models.OutboxMessage{}
+
+		err = rows.Scan(&message.ID, &message.ChatID, &message.Text, &message.ParseMode, &message.Keyboard, &message.Silent,
+			&message.Status, &message.Attempts, &message.NextAttemptAt, &message.LastError)
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+func (p *Postgres) UpdateMessage(ctx context.Context, message *models.OutboxMessage) error {
+	pool := p.pool
+
+	_, err := pool.Exec(ctx, `UPDATE outbox SET status = $2, attempts = $3, next_attempt_at = $4, last_error = $5, `+
+		`finished_at = CASE WHEN $2 <> 'pending' THEN now() END WHERE id = $1`,
+		message.ID, string(message.Status), message.Attempts, message.NextAttemptAt, message.LastError)
+
+	return err
+}
+
+func (p *Postgres) GetConversation(ctx context.Context, userID int) (*models.Conversation, error) {
+	pool := p.pool
+
+	conversation := &models.Conversation{UserID: userID, Values: make(map[string]string)}
+
+	err := pool.QueryRow(ctx, `SELECT status, data, updated_at, expires_at, expired FROM conversations WHERE user_id = $1`, userID).
+		Scan(&conversation.Status, &conversation.Values, &conversation.UpdatedAt, &conversation.ExpiresAt, &conversation.Expired)
+
+	if err == pgx.ErrNoRows {
+		return conversation, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return conversation, nil
+}
+
+func (p *Postgres) SaveConversation(ctx context.Context, conversation *models.Conversation) error {
+	pool := p.pool
+
+	values := conversation.Values
+
+	if values == nil {
+		values = make(map[string]string)
+	}
+
+	return pool.QueryRow(ctx, `INSERT INTO conversations(user_id, status, data, expires_at, expired) VALUES ($1, $2, $3, $4, $5) `+
+		`ON CONFLICT (user_id) DO UPDATE SET status = excluded.status, data = excluded.data, updated_at = now(), expires_at = excluded.expires_at, expired = excluded.expired `+
+		`RETURNING updated_at`,
+		conversation.UserID, conversation.Status, values, conversation.ExpiresAt, conversation.Expired).
+		Scan(&conversation.UpdatedAt)
+}
+
+func (p *Postgres) SweepConversations(ctx context.Context, now time.Time, keep time.Duration) (int, int, error) {
+	pool := p.pool
+
+	tx, err := pool.Begin(ctx)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	// Deleting goes first, a flow which expires now is kept to tell the user about it
+	deleted, err := tx.Exec(ctx, `DELETE FROM conversations WHERE (expires_at <= $1 AND status = 0 AND NOT expired) OR (expires_at <= $2 AND expired)`, now, now.Add(-keep))
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expired, err := tx.Exec(ctx, `UPDATE conversations SET status = 0, data = '{}', expired = true WHERE expires_at <= $1 AND status <> 0 AND NOT expired`, now)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(expired.RowsAffected()), int(deleted.RowsAffected()), tx.Commit(ctx)
+}
+
+func (p *Postgres) IsLeader(ctx context.Context) (bool, error) {
+	p.leaderMu.Lock()
+	defer p.leaderMu.Unlock()
+
+	if p.leader != nil {
+		// The lock lives as long as the session does, so a live connection is enough
+		err := p.leader.Conn().Ping(ctx)
+
+		if err == nil {
+			return true, nil
+		}
+
+		// Closing the connection drops the lock and keeps the pool from reusing it
+		p.leader.Conn().Close(ctx)
+		p.leader.Release()
+		p.leader = nil
+
+		return false, err
+	}
+
+	conn, err := p.pool.Acquire(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	var locked bool
+
+	err = conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, leaderLockID).Scan(&locked)
+
+	if err != nil || !locked {
+		conn.Release()
+		return false, err
+	}
+
+	p.leader = conn
+
+	return true, nil
 }
 
 func (p *Postgres) SetChatIDByUserID(ctx context.Context, chatID int64, userID int) error {
 	pool := p.pool
 
-	_, err := pool.Exec(ctx, `INSERT INTO user_chat_links(user_id, chat_id) VALUES($1, $2)`, userID, chatID)
+	// Called on every update, so an unchanged link is not rewritten
+	_, err := pool.Exec(ctx, `INSERT INTO user_chat_links(user_id, chat_id) VALUES($1, $2) ON CONFLICT (user_id) DO UPDATE SET chat_id = excluded.chat_id, active = true `+
+		`WHERE user_chat_links.chat_id <> excluded.chat_id OR NOT user_chat_links.active`, userID, chatID)
+
+	return err
+}
+
+func (p *Postgres) DeactivateChat(ctx context.Context, chatID int64) error {
+	pool := p.pool
+
+	_, err := pool.Exec(ctx, `UPDATE user_chat_links SET active = false WHERE chat_id = $1`, chatID)
 
 	return err
 }
@@ -212,7 +739,7 @@ func (p *Postgres) GetChatIDsByUserIDs(ctx context.Context, userIDs []int) (map[
 
 	ids := make(map[int]int64, len(userIDs))
 
-	rows, err := pool.Query(ctx, `SELECT chat_id, user_id from user_chat_links WHERE user_id = ANY($1)`, userIDs)
+	rows, err := pool.Query(ctx, `SELECT chat_id, user_id from user_chat_links WHERE user_id = ANY($1) AND active`, userIDs)
 
 	if err != nil {
 		return ids, err
@@ -238,10 +765,10 @@ func (p *Postgres) GetChatIDsByUserIDs(ctx context.Context, userIDs []int) (map[
 	return ids, err
 }
 
-func (p *Postgres) GetTodayItems(ctx context.Context) ([]*models.Item, error) {
+func (p *Postgres) GetTodayItems(ctx context.Context, userID int, today time.Time) ([]*models.Progress, error) {
 	pool := p.pool
 
-	rows, err := pool.Query(ctx, `SELECT * FROM items WHERE repeat_at = current_date ORDER BY group_id, id`)
+	rows, err := pool.Query(ctx, progressSelect+` WHERE ui.user_id = $1 AND ui.repeat_at = $2::date AND ui.mastered_at IS NULL ORDER BY i.group_id, i.id`, userID, today)
 
 	if err != nil {
 		return nil, err
@@ -249,21 +776,7 @@ func (p *Postgres) GetTodayItems(ctx context.Context) ([]*models.Item, error) {
 
 	defer rows.Close()
 
-	items := make([]*models.Item, 0)
-
-	for rows.Next() {
-		item := &models.Item{}
-
-		err = rows.Scan(&item.ID, &item.URL, &item.Name, &item.GroupID, &item.RepeatAt, &item.Counter)
-
-		if err != nil {
-			return nil, err
-		}
-
-		items = append(items, item)
-	}
-
-	return items, nil
+	return scanProgress(rows)
 }
 
 func (p *Postgres) GetChatIDsByItemIDs(ctx context.Context, itemIDs []int) (map[int][]int64, error) {
@@ -297,18 +810,186 @@ func (p *Postgres) GetChatIDsByItemIDs(ctx context.Context, itemIDs []int) (map[
 	return items, nil
 }
 
-func (p *Postgres) ProlongByItemIDWithCheck(ctx context.Context, itemID, counter int) error {
+func (p *Postgres) ProlongByItemIDWithCheck(ctx context.Context, userID, itemID, version int, grade scheduler.Grade, today time.Time) (*models.Progress, error) {
 	pool := p.pool
 
-	_, err := pool.Exec(ctx, `UPDATE items SET repeat_at = current_date + (SELECT add FROM prolong WHERE count = (SELECT counter FROM items WHERE id = $1 LIMIT 1) LIMIT 1), counter = $2 + 1 WHERE id = $1 AND counter = $2`, itemID, counter)
+	tx, err := pool.Begin(ctx)
 
-	return err
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	state := scheduler.State{}
+	dueAt := time.Time{}
+
+	err = tx.QueryRow(ctx, `SELECT counter, ease, interval_days, coalesce(due_since, repeat_at) FROM user_items WHERE user_id = $1 AND item_id = $2 AND version = $3 AND mastered_at IS NULL FOR UPDATE`, userID, itemID, version).
+		Scan(&state.Counter, &state.Ease, &state.Interval, &dueAt)
+
+	// The item has already been prolonged or has graduated
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	counter := state.Counter
+
+	state, err = p.sched.Next(state, grade)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE user_items SET repeat_at = $7::date + $3::integer, due_since = NULL, counter = $4, ease = $5, interval_days = $3, version = version + 1, mastered_at = CASE WHEN $6::boolean THEN $7::date END WHERE user_id = $1 AND item_id = $2`,
+		userID, itemID, state.Interval, state.Counter, state.Ease, state.Mastered, today)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO reviews(user_id, item_id, group_id, old_counter, new_counter, grade, due_at) VALUES ($1, $2, (SELECT group_id FROM items WHERE id = $2), $3, $4, $5, $6)`,
+		userID, itemID, counter, state.Counter, int(grade), dueAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, progressSelect+` WHERE ui.user_id = $1 AND ui.item_id = $2`, userID, itemID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := scanProgress(rows)
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return items[0], tx.Commit(ctx)
 }
 
-func (p *Postgres) ProlongYesterdayItem(ctx context.Context) error {
+func (p *Postgres) ProlongYesterdayItem(ctx context.Context, userID int, today time.Time) error {
 	pool := p.pool
 
-	_, err := pool.Exec(ctx, `UPDATE items SET repeat_at = current_date WHERE repeat_at < current_date`)
+	_, err := pool.Exec(ctx, `UPDATE user_items SET due_since = coalesce(due_since, repeat_at), repeat_at = $2::date WHERE user_id = $1 AND repeat_at < $2::date AND mastered_at IS NULL`, userID, today)
 
 	return err
 }
+
+func (p *Postgres) SnoozeByItemIDWithCheck(ctx context.Context, userID, itemID, version, days int, today time.Time) (*models.Progress, error) {
+	pool := p.pool
+
+	rows, err := pool.Query(ctx, `WITH ui AS (UPDATE user_items SET repeat_at = $5::date + $4::integer, due_since = NULL, version = version + 1 WHERE user_id = $1 AND item_id = $2 AND version = $3 AND mastered_at IS NULL RETURNING *) `+
+		`SELECT i.id, i.url, i.name, i.group_id, ui.user_id, ui.repeat_at, ui.counter, ui.ease, ui.interval_days, ui.mastered_at, ui.version FROM ui INNER JOIN items i ON i.id = ui.item_id`,
+		userID, itemID, version, days, today)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items, err := scanProgress(rows)
+
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+func (p *Postgres) ReviveItem(ctx context.Context, userID, itemID int, today time.Time) (*models.Progress, error) {
+	pool := p.pool
+
+	rows, err := pool.Query(ctx, `WITH ui AS (UPDATE user_items SET repeat_at = $3::date + 1, due_since = NULL, counter = 0, ease = 2.5, interval_days = 0, version = version + 1, mastered_at = NULL WHERE user_id = $1 AND item_id = $2 AND mastered_at IS NOT NULL RETURNING *) `+
+		`SELECT i.id, i.url, i.name, i.group_id, ui.user_id, ui.repeat_at, ui.counter, ui.ease, ui.interval_days, ui.mastered_at, ui.version FROM ui INNER JOIN items i ON i.id = ui.item_id`,
+		userID, itemID, today)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items, err := scanProgress(rows)
+
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+func (p *Postgres) GetReviewsByUserID(ctx context.Context, userID int) ([]*models.Review, error) {
+	pool := p.pool
+
+	rows, err := pool.Query(ctx, reviewSelect+` WHERE user_id = $1 ORDER BY reviewed_at`, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanReviews(rows)
+}
+
+func (p *Postgres) GetReviewsByGroupID(ctx context.Context, groupID int) ([]*models.Review, error) {
+	pool := p.pool
+
+	rows, err := pool.Query(ctx, reviewSelect+` WHERE group_id = $1 ORDER BY reviewed_at`, groupID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanReviews(rows)
+}
+
+const reviewSelect = `SELECT id, user_id, item_id, group_id, old_counter, new_counter, grade, due_at, reviewed_at FROM reviews`
+
+func scanReviews(rows pgx.Rows) ([]*models.Review, error) {
+	reviews := make([]*models.Review, 0)
+
+	for rows.Next() {
+		review := &models.Review{}
+
+		err := rows.Scan(&review.ID, &review.UserID, &review.ItemID, &review.GroupID, &review.OldCounter, &review.NewCounter, &review.Grade, &review.DueAt, &review.ReviewedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		reviews = append(reviews, review)
+	}
+
+	return reviews, rows.Err()
+}
+
+const progressSelect = `SELECT i.id, i.url, i.name, i.group_id, ui.user_id, ui.repeat_at, ui.counter, ui.ease, ui.interval_days, ui.mastered_at, ui.version FROM user_items ui INNER JOIN items i ON i.id = ui.item_id`
+
+func scanProgress(rows pgx.Rows) ([]*models.Progress, error) {
+	items := make([]*models.Progress, 0)
+
+	for rows.Next() {
+		item := &models.Progress{Item: &models.Item{}}
+
+		err := rows.Scan(&item.ID, &item.URL, &item.Name, &item.GroupID, &item.UserID, &item.RepeatAt, &item.Counter, &item.Ease, &item.Interval, &item.MasteredAt, &item.Version)
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gungniir/telegram-quezlet-bot/models"
+)
+
+func TestClaimReminder(t *testing.T) {
+	backends(t, func(t *testing.T, db Database) {
+		ctx := context.Background()
+
+		messages := func() []*models.OutboxMessage {
+			return []*models.OutboxMessage{{ChatID: 5, Text: "greeting"}, {ChatID: 5, Text: "digest"}}
+		}
+
+		claims := []struct {
+			day  time.Time
+			want bool
+		}{
+			{today, true},
+			{today, false},
+			{today.AddDate(0, 0, -1), false},
+			{today.AddDate(0, 0, 1), true},
+		}
+
+		for _, claim := range claims {
+			claimed, err := db.ClaimReminder(ctx, 1, claim.day, messages())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claimed != claim.want {
+				t.Errorf("claim on %s = %t, want %t", claim.day.Format("2006-01-02"), claimed, claim.want)
+			}
+		}
+
+		due, err := db.GetDueMessages(ctx, time.Now().Add(time.Minute), 100)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the two successful claims enqueue their messages
+		if len(due) != 4 {
+			t.Errorf("got %d messages in the outbox, want 4", len(due))
+		}
+	})
+}
@@ -0,0 +1,1040 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gungniir/telegram-quezlet-bot/models"
+	"github.com/gungniir/telegram-quezlet-bot/scheduler"
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const sqliteDateLayout = "2006-01-02"
+
+// SQLite has no notion of a session time zone, so unlike Postgres the current date
+// is computed by the application in loc and passed to every query that needs it
+type SQLite struct {
+	db    *sql.DB
+	loc   *time.Location
+	sched scheduler.Scheduler
+}
+
+// NewSQLite opens the database file and migrates it. A nil sched falls back
+// to the table schedule from the prolong table.
+func NewSQLite(path string, loc *time.Location, sched scheduler.Scheduler) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000", path))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer anyway, one connection saves us from "database is locked"
+	db.SetMaxOpenConns(1)
+
+	s := &SQLite{
+		db:    db,
+		loc:   loc,
+		sched: sched,
+	}
+
+	err = s.migrate(context.Background())
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if s.sched == nil {
+		intervals, err := s.getProlong(context.Background())
+
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		s.sched = scheduler.NewTable(intervals)
+	}
+
+	return s, nil
+}
+
+func (s *SQLite) getProlong(ctx context.Context) (map[int]int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT count, "add" FROM prolong`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	intervals := make(map[int]int)
+
+	for rows.Next() {
+		var count, add int
+
+		err = rows.Scan(&count, &add)
+
+		if err != nil {
+			return nil, err
+		}
+
+		intervals[count] = add
+	}
+
+	return intervals, rows.Err()
+}
+
+func (s *SQLite) migrate(ctx context.Context) error {
+	migrations, err := loadMigrations("sqlite")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP)`)
+
+	if err != nil {
+		return err
+	}
+
+	var current int
+
+	err = s.db.QueryRowContext(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&current)
+
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := s.db.BeginTx(ctx, nil)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, m.sql)
+
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations(version, name) VALUES (?, ?)`, m.version, m.name)
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Applied migration %s", m.name)
+	}
+
+	return nil
+}
+
+// today is the analogue of current_date in Postgres
+func (s *SQLite) today() string {
+	return time.Now().In(s.loc).Format(sqliteDateLayout)
+}
+
+// sqliteDateAfter is the date days after the local date today, as it is stored
+func sqliteDateAfter(today time.Time, days int) string {
+	return today.AddDate(0, 0, days).Format(sqliteDateLayout)
+}
+
+func (s *SQLite) GetDate(_ context.Context) (*time.Time, error) {
+	current, err := time.Parse(sqliteDateLayout, s.today())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &current, nil
+}
+
+func (s *SQLite) CreateGroup(ctx context.Context, passwordHash string) (*models.Group, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO groups(password_hash) VALUES (?)`, passwordHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return nil, err
+	}
+
+	group := &models.Group{
+		ID:           int(id),
+		PasswordHash: passwordHash,
+	}
+
+	return group, nil
+}
+
+func (s *SQLite) GetGroup(ctx context.Context, groupID int) (*models.Group, error) {
+	group := &models.Group{}
+
+	err := s.db.QueryRowContext(ctx, `SELECT id, password_hash FROM groups WHERE id = ?`, groupID).Scan(&group.ID, &group.PasswordHash)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+func (s *SQLite) AddUserToGroup(ctx context.Context, userID, groupID int, today time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO groups_users_links(user_id, group_id) VALUES (?, ?)`, userID, groupID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO user_items(user_id, item_id, repeat_at) SELECT ?, id, ? FROM items WHERE group_id = ? ON CONFLICT DO NOTHING`, userID, sqliteDateAfter(today, 1), groupID)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLite) RemoveUserFromGroup(ctx context.Context, userID, groupID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM groups_users_links WHERE user_id = ? AND group_id = ?`, userID, groupID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_items WHERE user_id = ? AND item_id IN (SELECT id FROM items WHERE group_id = ?)`, userID, groupID)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLite) GetUserGroups(ctx context.Context, userID int) ([]*models.Group, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT g.id, g.password_hash FROM groups_users_links INNER JOIN groups g on g.id = groups_users_links.group_id WHERE user_id = ? ORDER BY g.id`, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var groups []*models.Group
+
+	for rows.Next() {
+		group := &models.Group{}
+
+		err = rows.Scan(&group.ID, &group.PasswordHash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+func (s *SQLite) GetItem(ctx context.Context, itemID int) (*models.Item, error) {
+	item := &models.Item{}
+
+	err := s.db.QueryRowContext(ctx, `SELECT id, url, name, group_id FROM items WHERE id = ?`, itemID).Scan(&item.ID, &item.URL, &item.Name, &item.GroupID)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (s *SQLite) GetItemsByGroupID(ctx context.Context, groupID int) ([]*models.Item, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, url, name, group_id FROM items WHERE group_id = ? ORDER BY id`, groupID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items := make([]*models.Item, 0)
+
+	for rows.Next() {
+		item := &models.Item{}
+
+		err = rows.Scan(&item.ID, &item.URL, &item.Name, &item.GroupID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s *SQLite) GetUserItemsByGroupID(ctx context.Context, userID, groupID int) ([]*models.Progress, error) {
+	rows, err := s.db.QueryContext(ctx, progressSelect+` WHERE ui.user_id = ? AND i.group_id = ? ORDER BY ui.repeat_at, i.id`, userID, groupID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanSQLiteProgress(rows)
+}
+
+func (s *SQLite) GetTodayItems(ctx context.Context, userID int, today time.Time) ([]*models.Progress, error) {
+	rows, err := s.db.QueryContext(ctx, progressSelect+` WHERE ui.user_id = ? AND ui.repeat_at = ? AND ui.mastered_at IS NULL ORDER BY i.group_id, i.id`, userID, today.Format(sqliteDateLayout))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanSQLiteProgress(rows)
+}
+
+func (s *SQLite) CreateItem(ctx context.Context, userID, groupID int, url, name string, today time.Time) (*models.Progress, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO items(url, name, group_id) VALUES (?, ?, ?)`, url, name, groupID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return nil, err
+	}
+
+	item := &models.Item{
+		ID:      int(id),
+		GroupID: groupID,
+		URL:     url,
+		Name:    name,
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO user_items(user_id, item_id, repeat_at) SELECT user_id, ?, ? FROM groups_users_links WHERE group_id = ?`, item.ID, sqliteDateAfter(today, 1), groupID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, progressSelect+` WHERE ui.user_id = ? AND ui.item_id = ?`, userID, item.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := scanSQLiteProgress(rows)
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("user %d is not in group %d", userID, groupID)
+	}
+
+	return items[0], tx.Commit()
+}
+
+func (s *SQLite) UpdateItem(ctx context.Context, item *models.Item) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE items SET url = ?, name = ? WHERE id = ?`, item.URL, item.Name, item.ID)
+
+	return err
+}
+
+func (s *SQLite) DeleteItem(ctx context.Context, itemID int) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM items WHERE id = ?`, itemID)
+
+	return err
+}
+
+func (s *SQLite) ProlongByItemIDWithCheck(ctx context.Context, userID, itemID, version int, grade scheduler.Grade, today time.Time) (*models.Progress, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	state := scheduler.State{}
+
+	var dueAt string
+
+	err = tx.QueryRowContext(ctx, `SELECT counter, ease, interval_days, coalesce(due_since, repeat_at) FROM user_items WHERE user_id = ? AND item_id = ? AND version = ? AND mastered_at IS NULL`, userID, itemID, version).
+		Scan(&state.Counter, &state.Ease, &state.Interval, &dueAt)
+
+	// The item has already been prolonged or has graduated
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	counter := state.Counter
+
+	state, err = s.sched.Next(state, grade)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var masteredAt interface{}
+
+	if state.Mastered {
+		masteredAt = sqliteDateAfter(today, 0)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE user_items SET repeat_at = ?, due_since = NULL, counter = ?, ease = ?, interval_days = ?, version = version + 1, mastered_at = ? WHERE user_id = ? AND item_id = ?`,
+		sqliteDateAfter(today, state.Interval), state.Counter, state.Ease, state.Interval, masteredAt, userID, itemID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO reviews(user_id, item_id, group_id, old_counter, new_counter, grade, due_at, reviewed_at) VALUES (?, ?, (SELECT group_id FROM items WHERE id = ?), ?, ?, ?, ?, ?)`,
+		userID, itemID, itemID, counter, state.Counter, int(grade), dueAt, time.Now().UTC().Format(time.RFC3339))
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, progressSelect+` WHERE ui.user_id = ? AND ui.item_id = ?`, userID, itemID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := scanSQLiteProgress(rows)
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return items[0], tx.Commit()
+}
+
+func (s *SQLite) ProlongYesterdayItem(ctx context.Context, userID int, today time.Time) error {
+	date := today.Format(sqliteDateLayout)
+
+	_, err := s.db.ExecContext(ctx, `UPDATE user_items SET due_since = coalesce(due_since, repeat_at), repeat_at = ? WHERE user_id = ? AND repeat_at < ? AND mastered_at IS NULL`, date, userID, date)
+
+	return err
+}
+
+func (s *SQLite) SnoozeByItemIDWithCheck(ctx context.Context, userID, itemID, version, days int, today time.Time) (*models.Progress, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE user_items SET repeat_at = ?, due_since = NULL, version = version + 1 WHERE user_id = ? AND item_id = ? AND version = ? AND mastered_at IS NULL`, sqliteDateAfter(today, days), userID, itemID, version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	if err != nil || affected == 0 {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, progressSelect+` WHERE ui.user_id = ? AND ui.item_id = ?`, userID, itemID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items, err := scanSQLiteProgress(rows)
+
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+func (s *SQLite) ReviveItem(ctx context.Context, userID, itemID int, today time.Time) (*models.Progress, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE user_items SET repeat_at = ?, due_since = NULL, counter = 0, ease = 2.5, interval_days = 0, version = version + 1, mastered_at = NULL WHERE user_id = ? AND item_id = ? AND mastered_at IS NOT NULL`, sqliteDateAfter(today, 1), userID, itemID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	if err != nil || affected == 0 {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, progressSelect+` WHERE ui.user_id = ? AND ui.item_id = ?`, userID, itemID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items, err := scanSQLiteProgress(rows)
+
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+func (s *SQLite) GetReviewsByUserID(ctx context.Context, userID int) ([]*models.Review, error) {
+	rows, err := s.db.QueryContext(ctx, reviewSelect+` WHERE user_id = ? ORDER BY reviewed_at`, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanSQLiteReviews(rows)
+}
+
+func (s *SQLite) GetReviewsByGroupID(ctx context.Context, groupID int) ([]*models.Review, error) {
+	rows, err := s.db.QueryContext(ctx, reviewSelect+` WHERE group_id = ? ORDER BY reviewed_at`, groupID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanSQLiteReviews(rows)
+}
+
+func (s *SQLite) GetUserSettings(ctx context.Context, userID int) (*models.UserSettings, error) {
+	settings := &models.UserSettings{UserID: userID}
+
+	err := s.db.QueryRowContext(ctx, `SELECT coalesce(timezone, ''), remind_at FROM user_settings WHERE user_id = ?`, userID).
+		Scan(&settings.Timezone, &settings.RemindAt)
+
+	if err == sql.ErrNoRows {
+		return settings, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func (s *SQLite) SetUserSettings(ctx context.Context, settings *models.UserSettings) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO user_settings(user_id, timezone, remind_at) VALUES (?, nullif(?, ''), ?) ON CONFLICT (user_id) DO UPDATE SET timezone = excluded.timezone, remind_at = excluded.remind_at`,
+		settings.UserID, settings.Timezone, settings.RemindAt)
+
+	return err
+}
+
+func (s *SQLite) GetUserSettingsList(ctx context.Context) ([]*models.UserSettings, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT ucl.user_id, coalesce(us.timezone, ''), us.remind_at, r.reminded_on FROM user_chat_links ucl `+
+		`LEFT JOIN user_settings us ON us.user_id = ucl.user_id LEFT JOIN reminders r ON r.user_id = ucl.user_id WHERE ucl.active ORDER BY ucl.user_id`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	list := make([]*models.UserSettings, 0)
+
+	for rows.Next() {
+		var (
+			settings   = &models.UserSettings{}
+			remindedOn sql.NullString
+		)
+
+		err = rows.Scan(&settings.UserID, &settings.Timezone, &settings.RemindAt, &remindedOn)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if remindedOn.Valid {
+			date, err := time.Parse(sqliteDateLayout, remindedOn.String)
+
+			if err != nil {
+				return nil, err
+			}
+
+			settings.RemindedOn = &date
+		}
+
+		list = append(list, settings)
+	}
+
+	return list, rows.Err()
+}
+
+func (s *SQLite) ClaimReminder(ctx context.Context, userID int, day time.Time, messages []*models.OutboxMessage) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO reminders(user_id, reminded_on) VALUES (?, ?) `+
+		`ON CONFLICT (user_id) DO UPDATE SET reminded_on = excluded.reminded_on WHERE reminders.reminded_on < excluded.reminded_on`,
+		userID, day.Format(sqliteDateLayout))
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	err = sqliteEnqueue(ctx, tx, messages)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (s *SQLite) EnqueueMessages(ctx context.Context, messages []*models.OutboxMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = sqliteEnqueue(ctx, tx, messages)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func sqliteEnqueue(ctx context.Context, tx *sql.Tx, messages []*models.OutboxMessage) error {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for _, message := range messages {
+		res, err := tx.ExecContext(ctx, `INSERT INTO outbox(chat_id, text, parse_mode, keyboard, silent, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			message.ChatID, message.Text, message.ParseMode, message.Keyboard, message.Silent, now.Format(time.RFC3339), now.Format(time.RFC3339))
+
+		if err != nil {
+			return err
+		}
+
+		id, err := res.LastInsertId()
+
+		if err != nil {
+			return err
+		}
+
+		message.ID = int(id)
+		message.Status = models.OutboxPending
+		message.Attempts = 0
+		message.NextAttemptAt = now
+	}
+
+	return nil
+}
+
+func (s *SQLite) GetDueMessages(ctx context.Context, now time.Time, limit int) ([]*models.OutboxMessage, error) {
+	due := now.UTC().Format(time.RFC3339)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, chat_id, text, parse_mode, keyboard, silent, status, attempts, next_attempt_at, last_error FROM outbox o `+
+		`WHERE status = 'pending' AND next_attempt_at <= ? `+
+		`AND NOT EXISTS (SELECT 1 FROM outbox w WHERE w.chat_id = o.chat_id AND w.status = 'pending' AND w.id < o.id AND w.next_attempt_at > ?) `+
+		`ORDER BY id LIMIT ?`, due, due, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	messages := make([]*models.OutboxMessage, 0)
+
+	for rows.Next() {
+		var nextAttemptAt string
+
+		message := &models.OutboxMessage{}
+
+		err = rows.Scan(&message.ID, &message.ChatID, &message.Text, &message.ParseMode, &message.Keyboard, &message.Silent,
+			&message.Status, &message.Attempts, &nextAttemptAt, &message.LastError)
+
+		if err != nil {
+			return nil, err
+		}
+
+		message.NextAttemptAt, err = time.Parse(time.RFC3339, nextAttemptAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+func (s *SQLite) UpdateMessage(ctx context.Context, message *models.OutboxMessage) error {
+	var finishedAt interface{}
+
+	if message.Status != models.OutboxPending {
+		finishedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	_, err := s.db.ExecContext(ctx, `UPDATE outbox SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, finished_at = ? WHERE id = ?`,
+		string(message.Status), message.Attempts, message.NextAttemptAt.UTC().Truncate(time.Second).Format(time.RFC3339), message.LastError, finishedAt, message.ID)
+
+	return err
+}
+
+func (s *SQLite) GetConversation(ctx context.Context, userID int) (*models.Conversation, error) {
+	var data, updatedAt, expiresAt string
+
+	conversation := &models.Conversation{UserID: userID, Values: make(map[string]string)}
+
+	err := s.db.QueryRowContext(ctx, `SELECT status, data, updated_at, expires_at, expired FROM conversations WHERE user_id = ?`, userID).
+		Scan(&conversation.Status, &data, &updatedAt, &expiresAt, &conversation.Expired)
+
+	if err == sql.ErrNoRows {
+		return conversation, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(data), &conversation.Values)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conversation.UpdatedAt, err = time.Parse(time.RFC3339, updatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conversation.ExpiresAt, err = time.Parse(time.RFC3339, expiresAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return conversation, nil
+}
+
+func (s *SQLite) SaveConversation(ctx context.Context, conversation *models.Conversation) error {
+	values := conversation.Values
+
+	if values == nil {
+		values = make(map[string]string)
+	}
+
+	data, err := json.Marshal(values)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO conversations(user_id, status, data, updated_at, expires_at, expired) VALUES (?, ?, ?, ?, ?, ?) `+
+		`ON CONFLICT (user_id) DO UPDATE SET status = excluded.status, data = excluded.data, updated_at = excluded.updated_at, expires_at = excluded.expires_at, expired = excluded.expired`,
+		conversation.UserID, conversation.Status, string(data), now.Format(time.RFC3339), conversation.ExpiresAt.UTC().Format(time.RFC3339), conversation.Expired)
+
+	if err != nil {
+		return err
+	}
+
+	conversation.UpdatedAt = now
+
+	return nil
+}
+
+func (s *SQLite) SweepConversations(ctx context.Context, now time.Time, keep time.Duration) (int, int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer tx.Rollback()
+
+	// Deleting goes first, a flow which expires now is kept to tell the user about it
+	res, err := tx.ExecContext(ctx, `DELETE FROM conversations WHERE (expires_at <= ? AND status = 0 AND NOT expired) OR (expires_at <= ? AND expired)`,
+		now.UTC().Format(time.RFC3339), now.Add(-keep).UTC().Format(time.RFC3339))
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	deleted, err := res.RowsAffected()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	res, err = tx.ExecContext(ctx, `UPDATE conversations SET status = 0, data = '{}', expired = 1 WHERE expires_at <= ? AND status <> 0 AND NOT expired`,
+		now.UTC().Format(time.RFC3339))
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expired, err := res.RowsAffected()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(expired), int(deleted), tx.Commit()
+}
+
+// IsLeader is always true, a SQLite file is never shared by several instances
+func (s *SQLite) IsLeader(_ context.Context) (bool, error) {
+	return true, nil
+}
+
+func (s *SQLite) SetChatIDByUserID(ctx context.Context, chatID int64, userID int) error {
+	// Called on every update, so an unchanged link is not rewritten
+	_, err := s.db.ExecContext(ctx, `INSERT INTO user_chat_links(user_id, chat_id) VALUES(?, ?) ON CONFLICT (user_id) DO UPDATE SET chat_id = excluded.chat_id, active = 1 `+
+		`WHERE user_chat_links.chat_id <> excluded.chat_id OR NOT user_chat_links.active`, userID, chatID)
+
+	return err
+}
+
+func (s *SQLite) DeactivateChat(ctx context.Context, chatID int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE user_chat_links SET active = 0 WHERE chat_id = ?`, chatID)
+
+	return err
+}
+
+func (s *SQLite) GetChatIDsByUserIDs(ctx context.Context, userIDs []int) (map[int]int64, error) {
+	ids := make(map[int]int64, len(userIDs))
+
+	if len(userIDs) == 0 {
+		return ids, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT chat_id, user_id from user_chat_links WHERE user_id IN (`+placeholders(len(userIDs))+`) AND active`, intArgs(userIDs)...)
+
+	if err != nil {
+		return ids, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			chatID int64
+			userID int
+		)
+
+		err = rows.Scan(&chatID, &userID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ids[userID] = chatID
+	}
+
+	return ids, rows.Err()
+}
+
+func (s *SQLite) GetChatIDsByItemIDs(ctx context.Context, itemIDs []int) (map[int][]int64, error) {
+	items := make(map[int][]int64)
+
+	if len(itemIDs) == 0 {
+		return items, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, chat_id FROM item_chats WHERE id IN (`+placeholders(len(itemIDs))+`)`, intArgs(itemIDs)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id     int
+			chatID int64
+		)
+
+		err = rows.Scan(&id, &chatID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		items[id] = append(items[id], chatID)
+	}
+
+	return items, rows.Err()
+}
+
+func scanSQLiteProgress(rows *sql.Rows) ([]*models.Progress, error) {
+	items := make([]*models.Progress, 0)
+
+	for rows.Next() {
+		var (
+			repeatAt   string
+			masteredAt sql.NullString
+		)
+
+		item := &models.Progress{Item: &models.Item{}}
+
+		err := rows.Scan(&item.ID, &item.URL, &item.Name, &item.GroupID, &item.UserID, &repeatAt, &item.Counter, &item.Ease, &item.Interval, &masteredAt, &item.Version)
+
+		if err != nil {
+			return nil, err
+		}
+
+		date, err := time.Parse(sqliteDateLayout, repeatAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		item.RepeatAt = &date
+
+		if masteredAt.Valid {
+			date, err := time.Parse(sqliteDateLayout, masteredAt.String)
+
+			if err != nil {
+				return nil, err
+			}
+
+			item.MasteredAt = &date
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func scanSQLiteReviews(rows *sql.Rows) ([]*models.Review, error) {
+	reviews := make([]*models.Review, 0)
+
+	for rows.Next() {
+		var dueAt, reviewedAt string
+
+		review := &models.Review{}
+
+		err := rows.Scan(&review.ID, &review.UserID, &review.ItemID, &review.GroupID, &review.OldCounter, &review.NewCounter, &review.Grade, &dueAt, &reviewedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		date, err := time.Parse(sqliteDateLayout, dueAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		review.DueAt = &date
+		review.ReviewedAt, err = time.Parse(time.RFC3339, reviewedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		reviews = append(reviews, review)
+	}
+
+	return reviews, rows.Err()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func intArgs(values []int) []interface{} {
+	args := make([]interface{}, len(values))
+
+	for i, v := range values {
+		args[i] = v
+	}
+
+	return args
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// Conversation is where the user is in a multi-step flow and what they have entered so far
+type Conversation struct {
+	UserID    int
+	Status    int
+	Values    map[string]string
+	UpdatedAt time.Time
+	ExpiresAt time.Time
+	// Expired is set by the sweeper on an abandoned flow, until the user is told about it
+	Expired bool
+}
@@ -1,9 +1,6 @@
 package models
 
-import (
-	"regexp"
-	"time"
-)
+import "regexp"
 
 var (
 	itemURLRegexp  = regexp.MustCompile(`http[s]?://(?:[a-zA-Z]|[0-9]|[$-_@.&+]|[!*(),]|(?:%[0-9a-fA-F][0-9a-fA-F]))+`)
@@ -11,12 +8,10 @@ var (
 )
 
 type Item struct {
-	ID       int
-	GroupID  int
-	URL      string
-	Name     string
-	RepeatAt *time.Time
-	Counter  int
+	ID      int
+	GroupID int
+	URL     string
+	Name    string
 }
 
 func (i *Item) CheckURL(a string) bool {
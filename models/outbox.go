@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+type OutboxStatus string
+
+const (
+	OutboxPending   OutboxStatus = "pending"
+	OutboxDelivered OutboxStatus = "delivered"
+	OutboxFailed    OutboxStatus = "failed"
+)
+
+// OutboxMessage is a message waiting in the outbox to be sent by the dispatcher
+type OutboxMessage struct {
+	ID        int
+	ChatID    int64
+	Text      string
+	ParseMode string
+	Keyboard  string // Inline keyboard as JSON, empty for none
+	Silent    bool   // No notification and no web page preview
+
+	Status        OutboxStatus
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
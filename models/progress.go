@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Progress is a user's own review schedule of an item shared with the group
+type Progress struct {
+	*Item
+	UserID   int
+	RepeatAt *time.Time
+	Counter  int
+	Ease     float64
+	Interval int
+	// Version changes on every review, snooze and revival, the buttons carry it to tell a stale tap
+	Version int
+
+	// MasteredAt is set once the item has graduated, it is not reminded of anymore
+	MasteredAt *time.Time
+}
+
+func (p *Progress) Mastered() bool {
+	return p.MasteredAt != nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"github.com/gungniir/telegram-quezlet-bot/scheduler"
+	"time"
+)
+
+type Review struct {
+	ID         int
+	UserID     int
+	ItemID     int
+	GroupID    int
+	OldCounter int
+	NewCounter int
+	Grade      scheduler.Grade
+	// DueAt is the date the item first fell due, not the one it was moved to while overdue
+	DueAt      *time.Time
+	ReviewedAt time.Time
+}
+
+// OnTime reports whether the review happened no later than the day it was due, in loc
+func (r *Review) OnTime(loc *time.Location) bool {
+	reviewed := r.ReviewedAt.In(loc)
+	reviewedDate := time.Date(reviewed.Year(), reviewed.Month(), reviewed.Day(), 0, 0, 0, 0, time.UTC)
+
+	return !reviewedDate.After(*r.DueAt)
+}
+
+type ReviewStats struct {
+	Total  int
+	OnTime int
+	Late   int
+	Streak int // Days in a row with at least one review, up to today
+}
+
+func NewReviewStats(reviews []*Review, now time.Time, loc *time.Location) *ReviewStats {
+	stats := &ReviewStats{}
+	days := make(map[string]bool)
+
+	for _, review := range reviews {
+		stats.Total++
+
+		if review.OnTime(loc) {
+			stats.OnTime++
+		} else {
+			stats.Late++
+		}
+
+		days[review.ReviewedAt.In(loc).Format("2006-01-02")] = true
+	}
+
+	day := now.In(loc)
+
+	// The streak is not broken until today is over
+	if !days[day.Format("2006-01-02")] {
+		day = day.AddDate(0, 0, -1)
+	}
+
+	for days[day.Format("2006-01-02")] {
+		stats.Streak++
+		day = day.AddDate(0, 0, -1)
+	}
+
+	return stats
+}
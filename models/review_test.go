@@ -0,0 +1,66 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewReviewStats(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	day := func(d int) *time.Time {
+		date := time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC)
+		return &date
+	}
+
+	review := func(due *time.Time, reviewedAt time.Time) *Review {
+		return &Review{DueAt: due, ReviewedAt: reviewedAt}
+	}
+
+	tests := []struct {
+		name    string
+		reviews []*Review
+		loc     *time.Location
+		want    ReviewStats
+	}{
+		{"no reviews", nil, time.UTC, ReviewStats{}},
+		{"on the due day", []*Review{review(day(10), now)}, time.UTC, ReviewStats{Total: 1, OnTime: 1, Streak: 1}},
+		{"ahead of time", []*Review{review(day(12), now)}, time.UTC, ReviewStats{Total: 1, OnTime: 1, Streak: 1}},
+		{"days late", []*Review{review(day(8), now)}, time.UTC, ReviewStats{Total: 1, Late: 1, Streak: 1}},
+		{
+			"late in UTC, on time in Moscow",
+			[]*Review{review(day(10), time.Date(2026, 3, 9, 22, 0, 0, 0, time.UTC))},
+			moscow,
+			ReviewStats{Total: 1, OnTime: 1, Streak: 1},
+		},
+		{
+			"streak goes on until today is over",
+			[]*Review{review(day(8), now.AddDate(0, 0, -2)), review(day(9), now.AddDate(0, 0, -1))},
+			time.UTC,
+			ReviewStats{Total: 2, OnTime: 2, Streak: 2},
+		},
+		{
+			"gap breaks the streak",
+			[]*Review{review(day(7), now.AddDate(0, 0, -3)), review(day(9), now.AddDate(0, 0, -1)), review(day(10), now)},
+			time.UTC,
+			ReviewStats{Total: 3, OnTime: 3, Streak: 2},
+		},
+		{
+			"several reviews a day",
+			[]*Review{review(day(10), now), review(day(9), now.Add(time.Hour))},
+			time.UTC,
+			ReviewStats{Total: 2, OnTime: 1, Late: 1, Streak: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := NewReviewStats(test.reviews, now, test.loc)
+
+			if *got != test.want {
+				t.Errorf("NewReviewStats() = %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// UserSettings are the user's own preferences, zero values stand for the bot defaults
+type UserSettings struct {
+	UserID   int
+	Timezone string // IANA name
+	RemindAt *int   // Minutes after local midnight
+
+	RemindedOn *time.Time // Local date of the last reminder, filled by GetUserSettingsList only
+}
@@ -0,0 +1,84 @@
+package scheduler
+
+import "fmt"
+
+// Grade is the quality of a review on the SM-2 scale from 0 (blackout) to 5 (perfect)
+type Grade int
+
+const (
+	GradeAgain Grade = 1
+	GradeHard  Grade = 3
+	GradeGood  Grade = 4
+	GradeEasy  Grade = 5
+)
+
+func (g Grade) Valid() bool {
+	return g >= 0 && g <= 5
+}
+
+// State is the part of a user's progress a scheduler works with
+type State struct {
+	Counter  int     // Successful reviews in a row
+	Ease     float64 // Ease factor, used by SM2 only
+	Interval int     // Days until the next review
+	Mastered bool    // The item needs no more reviews
+}
+
+// Scheduler decides when a reviewed item comes up again
+type Scheduler interface {
+	Next(state State, grade Grade) (State, error)
+}
+
+// DefaultIntervals are the days added after a review with the given counter,
+// the same as the seed of the prolong table
+var DefaultIntervals = map[int]int{0: 1, 1: 2, 2: 4, 3: 7, 4: 14, 5: 30, 6: 60, 7: 120}
+
+// Table is the classic schedule: the interval is looked up by the counter.
+// Again starts the item over, Hard repeats the current step and Easy skips one.
+// An item reviewed past the last step is mastered.
+type Table struct {
+	intervals map[int]int
+}
+
+func NewTable(intervals map[int]int) *Table {
+	copied := make(map[int]int, len(intervals))
+
+	for count, add := range intervals {
+		copied[count] = add
+	}
+
+	return &Table{intervals: copied}
+}
+
+func (t *Table) Next(state State, grade Grade) (State, error) {
+	step := state.Counter
+
+	switch {
+	case grade < GradeHard:
+		step = 0
+	case grade == GradeHard && step > 0:
+		step--
+	case grade == GradeEasy:
+		if _, ok := t.intervals[step+1]; ok {
+			step++
+		}
+	}
+
+	add, ok := t.intervals[step]
+
+	if !ok {
+		if step == 0 {
+			return state, fmt.Errorf("no interval for counter %d", step)
+		}
+
+		state.Counter = step
+		state.Mastered = true
+
+		return state, nil
+	}
+
+	state.Interval = add
+	state.Counter = step + 1
+
+	return state, nil
+}
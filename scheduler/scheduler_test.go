@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTableNext(t *testing.T) {
+	table := NewTable(DefaultIntervals)
+
+	tests := []struct {
+		name  string
+		state State
+		grade Grade
+		want  State
+	}{
+		{"new item", State{}, GradeGood, State{Counter: 1, Interval: 1}},
+		{"good grows", State{Counter: 3, Interval: 4}, GradeGood, State{Counter: 4, Interval: 7}},
+		{"hard repeats the step", State{Counter: 3, Interval: 4}, GradeHard, State{Counter: 3, Interval: 4}},
+		{"hard on a new item", State{}, GradeHard, State{Counter: 1, Interval: 1}},
+		{"again starts over", State{Counter: 5, Interval: 30}, GradeAgain, State{Counter: 1, Interval: 1}},
+		{"easy skips a step", State{Counter: 3, Interval: 4}, GradeEasy, State{Counter: 5, Interval: 14}},
+		{"easy on the last step", State{Counter: 7, Interval: 60}, GradeEasy, State{Counter: 8, Interval: 120}},
+		{"past the last step", State{Counter: 8, Interval: 120}, GradeGood, State{Counter: 8, Interval: 120, Mastered: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := table.Next(test.state, test.grade)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("Next(%+v, %d) = %+v, want %+v", test.state, test.grade, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTableNextWithoutIntervals(t *testing.T) {
+	_, err := NewTable(nil).Next(State{}, GradeGood)
+
+	if err == nil {
+		t.Error("Next with no intervals succeeded")
+	}
+}
+
+func TestSM2Next(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+		grade Grade
+		want  State
+	}{
+		{"new item", State{}, GradeGood, State{Counter: 1, Interval: 1, Ease: 2.5}},
+		{"second review", State{Counter: 1, Interval: 1, Ease: 2.5}, GradeGood, State{Counter: 2, Interval: 6, Ease: 2.5}},
+		{"grows by ease", State{Counter: 2, Interval: 6, Ease: 2.5}, GradeGood, State{Counter: 3, Interval: 15, Ease: 2.5}},
+		{"hard lowers ease", State{Counter: 2, Interval: 6, Ease: 2.5}, GradeHard, State{Counter: 3, Interval: 15, Ease: 2.36}},
+		{"easy jumps further", State{Counter: 2, Interval: 6, Ease: 2.5}, GradeEasy, State{Counter: 3, Interval: 21, Ease: 2.6}},
+		{"again starts over", State{Counter: 5, Interval: 100, Ease: 2}, GradeAgain, State{Counter: 0, Interval: 1, Ease: 2}},
+		{"ease has a floor", State{Counter: 2, Interval: 6, Ease: 1.3}, GradeHard, State{Counter: 3, Interval: 8, Ease: 1.3}},
+		{"graduation", State{Counter: 5, Interval: 200, Ease: 2.5}, GradeGood, State{Counter: 6, Interval: 500, Ease: 2.5, Mastered: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SM2{}.Next(test.state, test.grade)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Counter != test.want.Counter || got.Interval != test.want.Interval || got.Mastered != test.want.Mastered ||
+				math.Abs(got.Ease-test.want.Ease) > 1e-9 {
+				t.Errorf("Next(%+v, %d) = %+v, want %+v", test.state, test.grade, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package scheduler
+
+import "math"
+
+const (
+	sm2InitialEase = 2.5
+	sm2MinimalEase = 1.3
+	sm2EasyBonus   = 1.3
+
+	// An item which would not come up again within a year is mastered
+	sm2MasteredInterval = 365
+)
+
+// SM2 is the SuperMemo 2 algorithm: intervals grow by the ease factor,
+// which in turn is adjusted by the grade of every review
+type SM2 struct{}
+
+func (SM2) Next(state State, grade Grade) (State, error) {
+	if state.Ease == 0 {
+		state.Ease = sm2InitialEase
+	}
+
+	// A failed recall starts the repetitions over, the ease stays as is
+	if grade < 3 {
+		state.Counter = 0
+		state.Interval = 1
+
+		return state, nil
+	}
+
+	switch state.Counter {
+	case 0:
+		state.Interval = 1
+	case 1:
+		state.Interval = 6
+	default:
+		if state.Interval < 1 {
+			state.Interval = 1
+		}
+
+		state.Interval = int(math.Round(float64(state.Interval) * state.Ease))
+	}
+
+	// Not in the original algorithm: an easy answer jumps further right away
+	if grade == GradeEasy {
+		state.Interval = int(math.Round(float64(state.Interval)*sm2EasyBonus)) + 1
+	}
+
+	state.Counter++
+
+	q := float64(5 - grade)
+	state.Ease += 0.1 - q*(0.08+q*0.02)
+
+	if state.Ease < sm2MinimalEase {
+		state.Ease = sm2MinimalEase
+	}
+
+	state.Mastered = state.Interval > sm2MasteredInterval
+
+	return state, nil
+}
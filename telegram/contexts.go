@@ -1,36 +1,105 @@
 package telegram
 
-import "sync"
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gungniir/telegram-quezlet-bot/database"
+	"github.com/gungniir/telegram-quezlet-bot/models"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
 
-type UserContext map[string]string
+const (
+	// A flow untouched for this long is abandoned
+	conversationTTL = 24 * time.Hour
+	// Expired flows are remembered this long to tell the user about them
+	expiredKeep   = 30 * 24 * time.Hour
+	sweepInterval = 10 * time.Minute
+)
 
-type UserContexts struct {
-	store map[int]UserContext
-	mu    sync.RWMutex
+// updateConversation changes the stored conversation of the user. Updates of
+// a user are handled one at a time, so nobody else changes it meanwhile.
+func updateConversation(db database.Database, userID int, change func(conversation *models.Conversation)) {
+	conversation, err := db.GetConversation(context.Background(), userID)
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to get conversation")
+		return
+	}
+
+	change(conversation)
+
+	conversation.ExpiresAt = time.Now().Add(conversationTTL)
+	conversation.Expired = false
+
+	err = db.SaveConversation(context.Background(), conversation)
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to save conversation")
+	}
 }
 
-func (c *UserContexts) Set(userID int, key, value string) {
-	c.mu.RLock()
-	if c.store == nil {
-		c.store = make(map[int]UserContext)
+// expired tells whether the flow of the user has expired. If so, the user is
+// told about it and returned to the main menu.
+func (s *TgServer) expired(ctx context.Context, msg *tgbotapi.Message) (bool, error) {
+	conversation, err := s.db.GetConversation(ctx, msg.From.ID)
+
+	if err != nil {
+		return false, err
 	}
-	if c.store[userID] == nil {
-		c.store[userID] = make(UserContext)
+
+	// The sweeper may not have got to the conversation yet
+	abandoned := conversation.Status != UStatusUndefined && !conversation.ExpiresAt.After(time.Now())
+
+	if !conversation.Expired && !abandoned {
+		return false, nil
 	}
-	c.mu.RUnlock()
 
-	c.mu.Lock()
-	c.store[userID][key] = value
-	c.mu.Unlock()
-}
-func (c *UserContexts) Get(userID int, key string) string {
-	c.mu.RLock()
-	if c.store == nil || c.store[userID] == nil {
-		return ""
+	conversation.Status = UStatusUndefined
+	conversation.Values = make(map[string]string)
+	conversation.ExpiresAt = time.Now().Add(conversationTTL)
+	conversation.Expired = false
+
+	err = s.db.SaveConversation(ctx, conversation)
+
+	if err != nil {
+		return false, err
+	}
+
+	kb := kbForAuthed
+
+	if len(forGroup(ctx)) == 0 {
+		kb = kbForNew
 	}
 
-	value := c.store[userID][key]
+	m := tgbotapi.NewMessage(msg.Chat.ID, "Вы давно не отвечали, и я забыл, на чём мы остановились... Начнём сначала!")
+	m.ReplyMarkup = kb
+
+	_, err = s.sender.Send(m)
+	return true, err
+}
+
+// startSweeper expires abandoned flows in the background
+func (s *TgServer) startSweeper() {
+	go func() {
+		for {
+			leader, err := s.db.IsLeader(context.Background())
+
+			if err != nil {
+				log.WithError(err).Error("Failed to check leadership")
+			}
+
+			if leader {
+				expired, deleted, err := s.db.SweepConversations(context.Background(), time.Now(), expiredKeep)
+
+				if err != nil {
+					log.WithError(err).Error("Failed to sweep conversations")
+				} else if expired > 0 || deleted > 0 {
+					log.Infof("Swept conversations: %d expired, %d deleted", expired, deleted)
+				}
+			}
 
-	c.mu.RUnlock()
-	return value
+			time.Sleep(sweepInterval)
+		}
+	}()
 }
@@ -0,0 +1,274 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gungniir/telegram-quezlet-bot/models"
+	log "github.com/sirupsen/logrus"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many modules a page of the digest lists
+const digestPageSize = 8
+
+// digestMessage renders a page of the digest of the group's due items as HTML. The page is
+// clamped to the existing ones, the keyboard is nil when nothing is left to review.
+func digestMessage(groupID int, items []*models.Progress, page int) (string, *tgbotapi.InlineKeyboardMarkup) {
+	header := fmt.Sprintf("<b>Модули группы √%d на сегодня</b>", groupID)
+
+	if len(items) == 0 {
+		return header + "\nВсё повторено, так держать! 🎉", nil
+	}
+
+	pages := (len(items) + digestPageSize - 1) / digestPageSize
+
+	if page >= pages {
+		page = pages - 1
+	}
+
+	if page < 0 {
+		page = 0
+	}
+
+	from := page * digestPageSize
+	to := from + digestPageSize
+
+	if to > len(items) {
+		to = len(items)
+	}
+
+	text := fmt.Sprintf("%s\nОсталось повторить: %d\n", header, len(items))
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, to-from+1)
+
+	for i, item := range items[from:to] {
+		// Names may have characters of the markup, such as _ in Unit_3
+		text += fmt.Sprintf("\n%d. <a href=\"%s\">%s</a>", from+i+1, html.EscapeString(item.URL), html.EscapeString(item.Name))
+
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(item.Name, fmt.Sprintf("DIGITEM:%d.%d", item.ID, page)),
+		))
+	}
+
+	if pages > 1 {
+		text += fmt.Sprintf("\n\nСтраница %d из %d", page+1, pages)
+
+		nav := make([]tgbotapi.InlineKeyboardButton, 0, 2)
+
+		if page > 0 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("◀ Назад", fmt.Sprintf("DIGEST:%d.%d", groupID, page-1)))
+		}
+
+		if page < pages-1 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Вперёд ▶", fmt.Sprintf("DIGEST:%d.%d", groupID, page+1)))
+		}
+
+		rows = append(rows, nav)
+	}
+
+	kb := tgbotapi.NewInlineKeyboardMarkup(rows...)
+
+	return text, &kb
+}
+
+// localDate is the date in loc at the moment, as a UTC midnight like the dates of the database
+func localDate(now time.Time, loc *time.Location) time.Time {
+	local := now.In(loc)
+
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// userLocation is the time zone of the user, the default one unless they have set their own
+func (s *TgServer) userLocation(ctx context.Context, userID int) (*time.Location, error) {
+	settings, err := s.db.GetUserSettings(ctx, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	loc, _ := s.ticker.schedule(settings)
+
+	return loc, nil
+}
+
+// userToday is the local date of the user at the moment
+func (s *TgServer) userToday(ctx context.Context, userID int) (time.Time, error) {
+	loc, err := s.userLocation(ctx, userID)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return localDate(time.Now(), loc), nil
+}
+
+// dueItems returns the user's items of the group which are due today
+func (s *TgServer) dueItems(ctx context.Context, userID, groupID int) ([]*models.Progress, error) {
+	today, err := s.userToday(ctx, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.db.GetUserItemsByGroupID(ctx, userID, groupID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	due := make([]*models.Progress, 0, len(items))
+
+	for _, item := range items {
+		if !item.Mastered() && item.RepeatAt != nil && !item.RepeatAt.After(today) {
+			due = append(due, item)
+		}
+	}
+
+	return due, nil
+}
+
+// editDigest turns the message of the query into the given page of the group's digest
+func (s *TgServer) editDigest(ctx context.Context, query *tgbotapi.CallbackQuery, groupID, page int) error {
+	items, err := s.dueItems(ctx, query.From.ID, groupID)
+
+	if err != nil {
+		return err
+	}
+
+	text, kb := digestMessage(groupID, items, page)
+
+	editText := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	editText.ParseMode = tgbotapi.ModeHTML
+	editText.DisableWebPagePreview = true
+	editText.ReplyMarkup = kb
+
+	_, err = s.sender.Send(editText)
+	return err
+}
+
+func (s *TgServer) queryDigest(ctx context.Context, query *tgbotapi.CallbackQuery) error {
+	t := strings.Split(strings.Split(query.Data, ":")[1], ".")
+
+	if len(t) < 2 {
+		log.Warn("Failed parse. Expected 2 params")
+		return nil
+	}
+
+	groupID, err := strconv.Atoi(t[0])
+
+	if err != nil {
+		log.WithError(err).Warn("Failed parse data")
+		return nil
+	}
+
+	page, err := strconv.Atoi(t[1])
+
+	if err != nil {
+		log.WithError(err).Warn("Failed parse data")
+		return nil
+	}
+
+	_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to answer query")
+	}
+
+	err = s.editDigest(ctx, query, groupID, page)
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to show digest")
+	}
+
+	return nil
+}
+
+// queryDigestItem opens a module of the digest, so that it can be graded or snoozed
+func (s *TgServer) queryDigestItem(ctx context.Context, query *tgbotapi.CallbackQuery) error {
+	t := strings.Split(strings.Split(query.Data, ":")[1], ".")
+
+	if len(t) < 2 {
+		log.Warn("Failed parse. Expected 2 params")
+		return nil
+	}
+
+	itemID, err := strconv.Atoi(t[0])
+
+	if err != nil {
+		log.WithError(err).Warn("Failed parse data")
+		return nil
+	}
+
+	page, err := strconv.Atoi(t[1])
+
+	if err != nil {
+		log.WithError(err).Warn("Failed parse data")
+		return nil
+	}
+
+	item, err := s.db.GetItem(ctx, itemID)
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to get item")
+	}
+
+	var progress *models.Progress
+
+	if item != nil {
+		items, err := s.dueItems(ctx, query.From.ID, item.GroupID)
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to get due items")
+		}
+
+		for _, due := range items {
+			if due.ID == itemID {
+				progress = due
+			}
+		}
+	}
+
+	if progress == nil {
+		_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Этот модуль уже повторён"))
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
+		}
+
+		if item != nil {
+			err = s.editDigest(ctx, query, item.GroupID, page)
+
+			if err != nil {
+				log.WithError(err).Warn("Failed to show digest")
+			}
+		}
+
+		return nil
+	}
+
+	_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to answer query")
+	}
+
+	editText := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+		fmt.Sprintf("<b>Модули группы √%d</b>\n\n%s\n<a href=\"%s\">Тыц по ссылке</a>", progress.GroupID, html.EscapeString(progress.Name), html.EscapeString(progress.URL)),
+	)
+	editText.ParseMode = tgbotapi.ModeHTML
+	editText.DisableWebPagePreview = true
+
+	kb := reviewKeyboard(progress, page)
+	editText.ReplyMarkup = &kb
+
+	_, err = s.sender.Send(editText)
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to edit text")
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package telegram
+
+import (
+	"fmt"
+	"github.com/gungniir/telegram-quezlet-bot/models"
+	"strings"
+	"testing"
+)
+
+func TestDigestMessage(t *testing.T) {
+	items := func(n int) []*models.Progress {
+		items := make([]*models.Progress, 0, n)
+
+		for i := 1; i <= n; i++ {
+			items = append(items, &models.Progress{Item: &models.Item{ID: i, GroupID: 7, Name: fmt.Sprintf("Module %d", i), URL: "https://quizlet.com/1"}})
+		}
+
+		return items
+	}
+
+	tests := []struct {
+		name     string
+		items    int
+		page     int
+		first    int    // Number of the first module on the page
+		modules  int    // Modules on the page
+		nav      string // Data of the navigation buttons
+		pageLine string
+	}{
+		{"one page", 3, 0, 1, 3, "", ""},
+		{"full page", digestPageSize, 0, 1, digestPageSize, "", ""},
+		{"first of three", 20, 0, 1, 8, "DIGEST:7.1", "Страница 1 из 3"},
+		{"middle", 20, 1, 9, 8, "DIGEST:7.0 DIGEST:7.2", "Страница 2 из 3"},
+		{"last", 20, 2, 17, 4, "DIGEST:7.1", "Страница 3 из 3"},
+		{"past the end", 20, 5, 17, 4, "DIGEST:7.1", "Страница 3 из 3"},
+		{"shrunk under the page", 9, 1, 9, 1, "DIGEST:7.0", "Страница 2 из 2"},
+		{"before the start", 9, -1, 1, 8, "DIGEST:7.1", "Страница 1 из 2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, kb := digestMessage(7, items(test.items), test.page)
+
+			if kb == nil {
+				t.Fatal("no keyboard")
+			}
+
+			rows := kb.InlineKeyboard
+			nav := make([]string, 0, 2)
+
+			if test.nav != "" {
+				for _, button := range rows[len(rows)-1] {
+					nav = append(nav, *button.CallbackData)
+				}
+
+				rows = rows[:len(rows)-1]
+			}
+
+			if got := strings.Join(nav, " "); got != test.nav {
+				t.Errorf("navigation is %q, want %q", got, test.nav)
+			}
+
+			if len(rows) != test.modules {
+				t.Fatalf("got %d module buttons, want %d", len(rows), test.modules)
+			}
+
+			if want := fmt.Sprintf("DIGITEM:%d.", test.first); !strings.HasPrefix(*rows[0][0].CallbackData, want) {
+				t.Errorf("first button is %s, want module %d", *rows[0][0].CallbackData, test.first)
+			}
+
+			if want := fmt.Sprintf("\n%d. ", test.first); !strings.Contains(text, want) {
+				t.Errorf("text has no module %d:\n%s", test.first, text)
+			}
+
+			if want := fmt.Sprintf("Осталось повторить: %d", test.items); !strings.Contains(text, want) {
+				t.Errorf("text has no %q:\n%s", want, text)
+			}
+
+			if test.pageLine != "" && !strings.Contains(text, test.pageLine) {
+				t.Errorf("text has no %q:\n%s", test.pageLine, text)
+			}
+		})
+	}
+}
+
+func TestDigestMessageDone(t *testing.T) {
+	text, kb := digestMessage(7, nil, 2)
+
+	if kb != nil {
+		t.Error("keyboard with nothing to review")
+	}
+
+	if !strings.Contains(text, "Всё повторено") {
+		t.Errorf("text is %q", text)
+	}
+}
+
+func TestDigestMessageEscapesNames(t *testing.T) {
+	item := &models.Progress{Item: &models.Item{ID: 1, GroupID: 7, Name: "Unit_3 <A & B>", URL: "https://quizlet.com/1?a=1&b=2"}}
+
+	text, _ := digestMessage(7, []*models.Progress{item}, 0)
+
+	want := `<a href="https://quizlet.com/1?a=1&amp;b=2">Unit_3 &lt;A &amp; B&gt;</a>`
+
+	if !strings.Contains(text, want) {
+		t.Errorf("text is %q, want it to have %q", text, want)
+	}
+}
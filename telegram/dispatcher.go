@@ -0,0 +1,162 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gungniir/telegram-quezlet-bot/database"
+	"github.com/gungniir/telegram-quezlet-bot/models"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	dispatchInterval = 5 * time.Second
+	dispatchBatch    = 100
+
+	// A message is retried after 10s, 20s, 40s... up to an hour, then given up
+	retryDelay    = 10 * time.Second
+	retryDelayMax = time.Hour
+	maxAttempts   = 10
+)
+
+// Dispatcher delivers the messages of the outbox, so that they survive crashes and Telegram outages
+type Dispatcher struct {
+	sender messageSender
+	db     database.Database
+	wake   chan struct{}
+}
+
+func (d *Dispatcher) StartDispatcher(sender messageSender, db database.Database) {
+	d.sender = sender
+	d.db = db
+	d.wake = make(chan struct{}, 1)
+
+	log.Info("Start dispatcher")
+
+	go func() {
+		for {
+			// Only the leader dispatches, or replicas would send the same messages
+			leader, err := d.db.IsLeader(context.Background())
+
+			if err != nil {
+				log.WithError(err).Error("Failed to check leadership")
+			}
+
+			if leader {
+				d.dispatch(time.Now())
+			}
+
+			select {
+			case <-d.wake:
+			case <-time.After(dispatchInterval):
+			}
+		}
+	}()
+}
+
+// Enqueue puts the messages into the outbox and wakes the dispatcher up
+func (d *Dispatcher) Enqueue(ctx context.Context, messages []*models.OutboxMessage) error {
+	err := d.db.EnqueueMessages(ctx, messages)
+
+	if err != nil {
+		return err
+	}
+
+	d.Wake()
+
+	return nil
+}
+
+// Wake makes the dispatcher look for messages enqueued bypassing Enqueue
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) dispatch(now time.Time) {
+	for {
+		messages, err := d.db.GetDueMessages(context.Background(), now, dispatchBatch)
+
+		if err != nil {
+			log.WithError(err).Error("Failed to get due messages")
+			return
+		}
+
+		// A failed message holds back the rest of its chat to keep the order
+		failed := make(map[int64]bool)
+
+		for _, message := range messages {
+			if failed[message.ChatID] {
+				continue
+			}
+
+			sent, err := d.deliver(message)
+
+			if err != nil {
+				// Without the update the message would be picked up and sent once more
+				log.WithError(err).Errorf("Failed to update message %d", message.ID)
+				return
+			}
+
+			if !sent {
+				failed[message.ChatID] = true
+			}
+		}
+
+		if len(messages) < dispatchBatch {
+			return
+		}
+	}
+}
+
+// deliver sends the message and records the outcome, it tells whether the message was sent
+func (d *Dispatcher) deliver(message *models.OutboxMessage) (bool, error) {
+	m := tgbotapi.NewMessage(message.ChatID, message.Text)
+	m.ParseMode = message.ParseMode
+	m.DisableNotification = message.Silent
+	m.DisableWebPagePreview = message.Silent
+
+	if message.Keyboard != "" {
+		m.ReplyMarkup = json.RawMessage(message.Keyboard)
+	}
+
+	_, err := d.sender.Send(m)
+
+	message.Attempts++
+
+	if err == nil {
+		message.Status = models.OutboxDelivered
+		message.LastError = ""
+	} else {
+		log.WithError(err).Warnf("Failed to deliver message %d, attempt %d", message.ID, message.Attempts)
+
+		message.LastError = err.Error()
+
+		// Retrying a gone chat is pointless, it is deactivated by the sender
+		if message.Attempts >= maxAttempts || chatGone(err) {
+			message.Status = models.OutboxFailed
+		} else {
+			message.NextAttemptAt = time.Now().Add(backoff(message.Attempts))
+		}
+	}
+
+	return err == nil, d.db.UpdateMessage(context.Background(), message)
+}
+
+// backoff is the delay before the next attempt after the given number of failed ones
+func backoff(attempts int) time.Duration {
+	delay := retryDelay
+
+	for i := 1; i < attempts && delay < retryDelayMax; i++ {
+		delay *= 2
+	}
+
+	if delay > retryDelayMax {
+		delay = retryDelayMax
+	}
+
+	return delay
+}
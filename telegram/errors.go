@@ -0,0 +1,133 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"runtime/debug"
+	"strings"
+)
+
+// UserError is a failure the user is told about with Text, Err is only logged
+type UserError struct {
+	Text string
+	Err  error
+}
+
+func (e *UserError) Error() string {
+	if e.Err == nil {
+		return e.Text
+	}
+
+	return e.Err.Error()
+}
+
+func (e *UserError) Unwrap() error {
+	return e.Err
+}
+
+type errorClass int
+
+const (
+	// A bug or an unexpected failure, the user gets an apology
+	errorInternal errorClass = iota
+	// The user gets the text of UserError
+	errorUser
+	// A temporary failure of Telegram or the database. Handlers are not idempotent,
+	// so the update is not replayed, the user is asked to repeat a bit later instead.
+	errorRetryable
+	// The chat is gone, there is nobody to tell
+	errorChatGone
+	// The bot cannot go on, e.g. the token has been revoked
+	errorFatal
+)
+
+func classify(err error) errorClass {
+	var (
+		userErr *UserError
+		apiErr  tgbotapi.Error
+		netErr  net.Error
+	)
+
+	switch {
+	case errors.As(err, &userErr):
+		return errorUser
+	case chatGone(err):
+		return errorChatGone
+	case errors.As(err, &apiErr):
+		if strings.Contains(apiErr.Message, "Unauthorized") {
+			return errorFatal
+		}
+
+		// Sender has already waited out retry_after as many times as it would
+		if apiErr.RetryAfter > 0 {
+			return errorRetryable
+		}
+	case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorRetryable
+	}
+
+	return errorInternal
+}
+
+// processUpdate handles the update, turning a panic into an error
+func (s *TgServer) processUpdate(update tgbotapi.Update) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	return s.handleUpdate(update)
+}
+
+// handleError tells the user about the failed update, only fatal errors are returned
+func (s *TgServer) handleError(update tgbotapi.Update, err error) error {
+	logger := log.WithError(err).WithField("update", update.UpdateID).WithField("user", updateUserID(update))
+
+	var text string
+
+	switch classify(err) {
+	case errorFatal:
+		return err
+	case errorChatGone:
+		logger.Info("Chat is gone while handling update")
+		return nil
+	case errorUser:
+		var userErr *UserError
+
+		errors.As(err, &userErr)
+
+		logger.Warn("Failed to handle update")
+		text = userErr.Text
+	case errorRetryable:
+		logger.Warn("Temporary failure while handling update")
+		text = "Кажется, у меня временные неполадки... Повторите, пожалуйста, через минутку"
+	default:
+		logger.Error("Failed to handle update")
+		text = "Ой, что-то пошло не так, простите! Попробуйте ещё раз или начните заново с /cancel"
+	}
+
+	var chatID int64
+
+	switch {
+	case update.Message != nil:
+		chatID = update.Message.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		chatID = update.CallbackQuery.Message.Chat.ID
+	default:
+		return nil
+	}
+
+	_, err = s.sender.Send(tgbotapi.NewMessage(chatID, text))
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to apologize")
+	}
+
+	return nil
+}
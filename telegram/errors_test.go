@@ -0,0 +1,38 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want errorClass
+	}{
+		{"bug", errors.New("nil group"), errorInternal},
+		{"user error", &UserError{Text: "Неверный пароль"}, errorUser},
+		{"wrapped user error", fmt.Errorf("join: %w", &UserError{Text: "Неверный пароль"}), errorUser},
+		{"blocked", tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"}, errorChatGone},
+		{"revoked token", tgbotapi.Error{Message: "Unauthorized"}, errorFatal},
+		{"too many requests", tgbotapi.Error{Message: "Too Many Requests", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, errorRetryable},
+		{"bad request", tgbotapi.Error{Message: "Bad Request: message is not modified"}, errorInternal},
+		{"network", fmt.Errorf("send: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), errorRetryable},
+		{"timeout", fmt.Errorf("query: %w", context.DeadlineExceeded), errorRetryable},
+		{"cut off", io.ErrUnexpectedEOF, errorRetryable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := classify(test.err); got != test.want {
+				t.Errorf("classify(%v) = %d, want %d", test.err, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,552 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gungniir/telegram-quezlet-bot/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const settingsKeep = "-"
+
+const (
+	flowCreateGroup = "create_group"
+	flowJoinGroup   = "join_group"
+	flowCreateItem  = "create_item"
+	flowLeaveGroup  = "leave_group"
+	flowRenameItem  = "rename_item"
+	flowSetItemURL  = "set_item_url"
+	flowSettings    = "settings"
+)
+
+type createGroupValues struct {
+	PasswordHash string `json:"password_hash"`
+}
+
+type joinGroupValues struct {
+	GroupID int `json:"group_id"`
+}
+
+type createItemValues struct {
+	GroupID int    `json:"group_id"`
+	URL     string `json:"url"`
+	Name    string `json:"name"`
+	// The URL and the name came from a Quizlet share message
+	Shared bool `json:"shared"`
+}
+
+type leaveGroupValues struct {
+	GroupID int `json:"group_id"`
+}
+
+type editItemValues struct {
+	ItemID   int    `json:"item_id"`
+	ItemName string `json:"item_name"` // The name when the item was picked, for the questions
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+}
+
+type settingsValues struct {
+	// Empty and nil keep the current settings
+	Timezone string `json:"timezone"`
+	RemindAt *int   `json:"remind_at"`
+}
+
+// groupIDs lists the groups as "1, 2, 3"
+func groupIDs(groups []*models.Group) string {
+	ids := make([]string, 0, len(groups))
+
+	for _, group := range groups {
+		ids = append(ids, strconv.Itoa(group.ID))
+	}
+
+	return strings.Join(ids, ", ")
+}
+
+// groupsReminder reminds the user of the groups they are in, empty if there are none
+func groupsReminder(groups []*models.Group) string {
+	switch len(groups) {
+	case 0:
+		return ""
+	case 1:
+		return "Напоминаю, что вы состоите в группе √" + groupIDs(groups) + "\n"
+	}
+
+	return "Напоминаю, что вы состоите в группах √" + groupIDs(groups) + "\n"
+}
+
+// groupStep chooses one of the groups of the user, it is skipped when there is only one
+func groupStep(question string, set func(state *FlowState, groupID int)) *Step {
+	return &Step{
+		Name: "group",
+		Skip: func(ctx context.Context, state *FlowState) bool {
+			groups := forGroup(ctx)
+
+			if len(groups) != 1 {
+				return false
+			}
+
+			set(state, groups[0].ID)
+			return true
+		},
+		Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+			return question + "\nВы находитесь в группах √" + groupIDs(forGroup(ctx)), nil
+		},
+		Options: func(ctx context.Context, state *FlowState) []string {
+			options := make([]string, 0)
+
+			for _, group := range forGroup(ctx) {
+				options = append(options, fmt.Sprintf("√%d", group.ID))
+			}
+
+			return options
+		},
+		Handle: func(ctx context.Context, state *FlowState, text string) error {
+			groupID, err := strconv.Atoi(strings.TrimPrefix(text, "√"))
+
+			if err != nil {
+				return &UserError{Text: "Вы уверены, что ввели число без всяких знаков? Повторите, пожалуйста, ещё раз"}
+			}
+
+			if !inGroups(forGroup(ctx), groupID) {
+				return &UserError{Text: fmt.Sprintf("Вы не входите в группу √%d", groupID)}
+			}
+
+			set(state, groupID)
+			return nil
+		},
+	}
+}
+
+// finished tells the user the flow is done and shows the main menu
+func (s *TgServer) finished(state *FlowState, kb tgbotapi.ReplyKeyboardMarkup, text string) error {
+	kb.OneTimeKeyboard = true
+
+	m := tgbotapi.NewMessage(state.Msg.Chat.ID, text)
+	m.ReplyMarkup = kb
+
+	_, err := s.sender.Send(m)
+	return err
+}
+
+func (s *TgServer) createGroupFlow() *Flow {
+	return &Flow{
+		Name: flowCreateGroup,
+		NewValues: func() interface{} {
+			return new(createGroupValues)
+		},
+		Steps: []*Step{
+			{
+				Name: "password",
+				Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+					return groupsReminder(forGroup(ctx)) + "Придумайте пароль (как минимум 3 символа латиницей или цифрами)", nil
+				},
+				Handle: func(ctx context.Context, state *FlowState, text string) error {
+					if !(*models.Group).CheckPassword(nil, text) {
+						return &UserError{Text: "Недопустимый пароль, попробуйте другой"}
+					}
+
+					state.Values.(*createGroupValues).PasswordHash = (*models.Group).HashPassword(nil, text)
+					return nil
+				},
+			},
+		},
+		Finish: func(ctx context.Context, state *FlowState) error {
+			today, err := s.userToday(ctx, state.Msg.From.ID)
+
+			if err != nil {
+				return err
+			}
+
+			group, err := s.db.CreateGroup(ctx, state.Values.(*createGroupValues).PasswordHash)
+
+			if err != nil {
+				return &UserError{Text: "Не получилось создать группу, попробуйте еще раз", Err: err}
+			}
+
+			err = s.db.AddUserToGroup(ctx, state.Msg.From.ID, group.ID, today)
+
+			if err != nil {
+				return &UserError{Text: "Не получилось создать группу, попробуйте еще раз", Err: err}
+			}
+
+			return s.finished(state, kbForAuthed,
+				"Отлично, группа создана!\n"+
+					"Вы можете пригласить в нее друзей по ID: "+strconv.Itoa(group.ID),
+			)
+		},
+	}
+}
+
+func (s *TgServer) joinGroupFlow() *Flow {
+	return &Flow{
+		Name: flowJoinGroup,
+		NewValues: func() interface{} {
+			return new(joinGroupValues)
+		},
+		Steps: []*Step{
+			{
+				Name: "group",
+				Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+					return groupsReminder(forGroup(ctx)) + "Введите ID группы, к которой хотите присоединиться", nil
+				},
+				Handle: func(ctx context.Context, state *FlowState, text string) error {
+					id, err := strconv.Atoi(text)
+
+					if err != nil {
+						return &UserError{Text: "Вы точно ввели число?"}
+					}
+
+					group, err := s.db.GetGroup(ctx, id)
+
+					if err != nil {
+						return &UserError{Text: "Не удалось проверить наличие группы, попробуйте ещё раз", Err: err}
+					}
+
+					if group == nil {
+						return &UserError{Text: "Такой группы не существует, попробуйте ввести другой ID"}
+					}
+
+					state.Values.(*joinGroupValues).GroupID = group.ID
+					return nil
+				},
+			},
+			{
+				Name: "password",
+				Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+					return "Хорошо, теперь введите пароль", nil
+				},
+				Handle: func(ctx context.Context, state *FlowState, text string) error {
+					if !(*models.Group).CheckPassword(nil, text) {
+						return &UserError{Text: "Неверный формат пароля, попробуйте ещё раз"}
+					}
+
+					group, err := s.db.GetGroup(ctx, state.Values.(*joinGroupValues).GroupID)
+
+					if err != nil {
+						return &UserError{Text: "Не удалось проверить наличие группы, попробуйте ещё раз", Err: err}
+					}
+
+					if group == nil {
+						return &UserError{Text: "Группа перестала существовать... Вернитесь назад и введите другой ID"}
+					}
+
+					if group.PasswordHash != group.HashPassword(text) {
+						return &UserError{Text: "Неверный пароль, попробуйте ещё раз"}
+					}
+
+					return nil
+				},
+			},
+		},
+		Finish: func(ctx context.Context, state *FlowState) error {
+			groupID := state.Values.(*joinGroupValues).GroupID
+
+			today, err := s.userToday(ctx, state.Msg.From.ID)
+
+			if err != nil {
+				return err
+			}
+
+			err = s.db.AddUserToGroup(ctx, state.Msg.From.ID, groupID, today)
+
+			if err != nil {
+				return &UserError{Text: "Не удалось добавить вас в группу, попробуйте ещё раз", Err: err}
+			}
+
+			return s.finished(state, kbForAuthed, "Добро пожаловать в группу √"+strconv.Itoa(groupID))
+		},
+	}
+}
+
+func (s *TgServer) createItemFlow() *Flow {
+	shared := func(_ context.Context, state *FlowState) bool {
+		return state.Values.(*createItemValues).Shared
+	}
+
+	return &Flow{
+		Name: flowCreateItem,
+		NewValues: func() interface{} {
+			return new(createItemValues)
+		},
+		Steps: []*Step{
+			groupStep("В какую группу вы хотите добавить модуль?", func(state *FlowState, groupID int) {
+				state.Values.(*createItemValues).GroupID = groupID
+			}),
+			{
+				Name: "url",
+				Skip: shared,
+				Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+					return "Скиньте ссылку на модуль", nil
+				},
+				Handle: func(ctx context.Context, state *FlowState, text string) error {
+					if !(*models.Item).CheckURL(nil, text) {
+						return &UserError{Text: "Проверьте ссылку, мне кажется, что она неверная"}
+					}
+
+					state.Values.(*createItemValues).URL = text
+					return nil
+				},
+			},
+			{
+				Name: "name",
+				Skip: shared,
+				Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+					return "Окей, а теперь введите название модуля", nil
+				},
+				Handle: func(ctx context.Context, state *FlowState, text string) error {
+					if !(*models.Item).CheckName(nil, text) {
+						return &UserError{Text: "Ухх, плохое название, придумайте другое"}
+					}
+
+					state.Values.(*createItemValues).Name = text
+					return nil
+				},
+			},
+		},
+		Finish: func(ctx context.Context, state *FlowState) error {
+			values := state.Values.(*createItemValues)
+
+			today, err := s.userToday(ctx, state.Msg.From.ID)
+
+			if err != nil {
+				return err
+			}
+
+			item, err := s.db.CreateItem(ctx, state.Msg.From.ID, values.GroupID, values.URL, values.Name, today)
+
+			if err != nil {
+				return &UserError{Text: "Тэкс... Я не смогу записать... Повторите, пожалуйста, еще раз...", Err: err}
+			}
+
+			return s.finished(state, kbForAuthed, fmt.Sprintf(
+				"Отлично! Карточка добавлена в группу √%d :)\nНазвание: %s\nПовторим её %02d.%02d.%d",
+				values.GroupID, item.Name, item.RepeatAt.Day(), item.RepeatAt.Month(), item.RepeatAt.Year(),
+			))
+		},
+	}
+}
+
+func (s *TgServer) leaveGroupFlow() *Flow {
+	return &Flow{
+		Name: flowLeaveGroup,
+		NewValues: func() interface{} {
+			return new(leaveGroupValues)
+		},
+		Steps: []*Step{
+			groupStep("Выберите группу, из которой хотите выйти", func(state *FlowState, groupID int) {
+				state.Values.(*leaveGroupValues).GroupID = groupID
+			}),
+		},
+		Finish: func(ctx context.Context, state *FlowState) error {
+			groupID := state.Values.(*leaveGroupValues).GroupID
+
+			err := s.db.RemoveUserFromGroup(ctx, state.Msg.From.ID, groupID)
+
+			if err != nil {
+				return &UserError{Text: "Не удалось выйти из группы, увы :(", Err: err}
+			}
+
+			kb := kbForAuthed
+
+			if len(forGroup(ctx)) <= 1 {
+				kb = kbForNew
+			}
+
+			return s.finished(state, kb, fmt.Sprintf("Вы вышли из группы √%d", groupID))
+		},
+	}
+}
+
+// editItemFlow changes the item picked with sendItemPicker, done applies the answer to it and returns the reply
+func (s *TgServer) editItemFlow(name string, step *Step, done func(item *models.Item, values *editItemValues) string) *Flow {
+	return &Flow{
+		Name: name,
+		NewValues: func() interface{} {
+			return new(editItemValues)
+		},
+		Steps: []*Step{step},
+		Finish: func(ctx context.Context, state *FlowState) error {
+			values := state.Values.(*editItemValues)
+
+			item, err := s.db.GetItem(ctx, values.ItemID)
+
+			if err != nil {
+				return &UserError{Text: "Не удалось найти модуль, попробуйте ещё раз", Err: err}
+			}
+
+			// The item is gone or the user has left its group meanwhile
+			if item == nil || !inGroups(forGroup(ctx), item.GroupID) {
+				return s.finished(state, kbForAuthed, "Этот модуль вам больше недоступен")
+			}
+
+			text := done(item, values)
+
+			err = s.db.UpdateItem(ctx, item)
+
+			if err != nil {
+				return &UserError{Text: "Тэкс... Я не смогу записать... Повторите, пожалуйста, еще раз...", Err: err}
+			}
+
+			return s.finished(state, kbForAuthed, text)
+		},
+	}
+}
+
+func (s *TgServer) renameItemFlow() *Flow {
+	return s.editItemFlow(flowRenameItem, &Step{
+		Name: "name",
+		Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+			return fmt.Sprintf("Введите новое название для «%s»", state.Values.(*editItemValues).ItemName), nil
+		},
+		Handle: func(ctx context.Context, state *FlowState, text string) error {
+			if !(*models.Item).CheckName(nil, text) {
+				return &UserError{Text: "Ухх, плохое название, придумайте другое"}
+			}
+
+			state.Values.(*editItemValues).Name = text
+			return nil
+		},
+	}, func(item *models.Item, values *editItemValues) string {
+		item.Name = values.Name
+
+		return fmt.Sprintf("Готово! Теперь модуль называется «%s»", item.Name)
+	})
+}
+
+func (s *TgServer) setItemURLFlow() *Flow {
+	return s.editItemFlow(flowSetItemURL, &Step{
+		Name: "url",
+		Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+			return fmt.Sprintf("Скиньте новую ссылку для «%s»", state.Values.(*editItemValues).ItemName), nil
+		},
+		Handle: func(ctx context.Context, state *FlowState, text string) error {
+			if !(*models.Item).CheckURL(nil, text) {
+				return &UserError{Text: "Проверьте ссылку, мне кажется, что она неверная"}
+			}
+
+			state.Values.(*editItemValues).URL = text
+			return nil
+		},
+	}, func(item *models.Item, values *editItemValues) string {
+		item.URL = values.URL
+
+		return fmt.Sprintf("Готово! Ссылка на «%s» обновлена", item.Name)
+	})
+}
+
+func (s *TgServer) settingsFlow() *Flow {
+	keep := func(ctx context.Context, state *FlowState) []string {
+		return []string{settingsKeep}
+	}
+
+	return &Flow{
+		Name: flowSettings,
+		NewValues: func() interface{} {
+			return new(settingsValues)
+		},
+		Steps: []*Step{
+			{
+				Name: "timezone",
+				Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+					settings, err := s.db.GetUserSettings(ctx, state.Msg.From.ID)
+
+					if err != nil {
+						return "", &UserError{Text: "Не удалось получить ваши настройки, попробуйте ещё раз", Err: err}
+					}
+
+					loc, remindAt := s.ticker.schedule(settings)
+
+					return fmt.Sprintf(
+						"Ваш часовой пояс: %s\nНапоминания приходят в %02d:%02d\n\n"+
+							"Введите новый часовой пояс, например Europe/Moscow, или «%s», чтобы оставить текущий",
+						loc.String(), remindAt/60, remindAt%60, settingsKeep,
+					), nil
+				},
+				Options: keep,
+				Handle: func(ctx context.Context, state *FlowState, text string) error {
+					values := state.Values.(*settingsValues)
+
+					if text == settingsKeep {
+						values.Timezone = ""
+						return nil
+					}
+
+					// Local is the time zone of the server, not a real one
+					if _, err := time.LoadLocation(text); err != nil || text == "" || text == "Local" {
+						return &UserError{Text: "Не знаю такого часового пояса. Нужно название вроде Europe/Moscow или Asia/Krasnoyarsk"}
+					}
+
+					values.Timezone = text
+					return nil
+				},
+			},
+			{
+				Name: "reminder",
+				Prompt: func(ctx context.Context, state *FlowState) (string, error) {
+					return fmt.Sprintf("Во сколько присылать напоминания? Введите время в формате ЧЧ:ММ или «%s», чтобы оставить текущее", settingsKeep), nil
+				},
+				Options: keep,
+				Handle: func(ctx context.Context, state *FlowState, text string) error {
+					values := state.Values.(*settingsValues)
+
+					if text == settingsKeep {
+						values.RemindAt = nil
+						return nil
+					}
+
+					remindAt, err := time.Parse("15:04", text)
+
+					if err != nil {
+						remindAt, err = time.Parse("15", text)
+					}
+
+					if err != nil {
+						return &UserError{Text: "Не понимаю, во сколько. Введите время в формате ЧЧ:ММ, например 07:30"}
+					}
+
+					minutes := remindAt.Hour()*60 + remindAt.Minute()
+					values.RemindAt = &minutes
+
+					return nil
+				},
+			},
+		},
+		Finish: func(ctx context.Context, state *FlowState) error {
+			values := state.Values.(*settingsValues)
+
+			settings, err := s.db.GetUserSettings(ctx, state.Msg.From.ID)
+
+			if err != nil {
+				return &UserError{Text: "Не удалось получить ваши настройки, попробуйте ещё раз", Err: err}
+			}
+
+			if values.Timezone != "" {
+				settings.Timezone = values.Timezone
+			}
+
+			if values.RemindAt != nil {
+				settings.RemindAt = values.RemindAt
+			}
+
+			err = s.db.SetUserSettings(ctx, settings)
+
+			if err != nil {
+				return &UserError{Text: "Тэкс... Я не смогу записать... Повторите, пожалуйста, еще раз...", Err: err}
+			}
+
+			loc, remindAt := s.ticker.schedule(settings)
+
+			kb := kbForAuthed
+
+			if forGroup(ctx) == nil {
+				kb = kbForNew
+			}
+
+			return s.finished(state, kb, fmt.Sprintf("Готово! Буду напоминать в %02d:%02d по часовому поясу %s", remindAt/60, remindAt%60, loc.String()))
+		},
+	}
+}
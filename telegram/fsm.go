@@ -0,0 +1,336 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gungniir/telegram-quezlet-bot/models"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	butBack   = "« Назад"
+	butCancel = "Отмена"
+
+	// Keys of the conversation values used by the state machine
+	flowKey    = "fsm_flow"
+	stepKey    = "fsm_step"
+	historyKey = "fsm_history"
+	valuesKey  = "fsm_values"
+)
+
+// Flow is a conversation of several steps, such as creating a group. The user
+// goes through the steps in order, may go back with butBack and leave with butCancel.
+type Flow struct {
+	Name  string
+	Steps []*Step
+
+	// NewValues returns a pointer to the typed values of the flow, they are kept between steps as JSON
+	NewValues func() interface{}
+	// Finish is called once the last step is done. A UserError keeps the user at the last step, if there was one.
+	Finish func(ctx context.Context, state *FlowState) error
+}
+
+// Step asks the user for a single answer
+type Step struct {
+	Name string
+
+	// Skip leaves the step out, e.g. choosing a group when the user has only one. Optional.
+	Skip func(ctx context.Context, state *FlowState) bool
+	// Prompt returns the question of the step
+	Prompt func(ctx context.Context, state *FlowState) (string, error)
+	// Options are offered as reply buttons. Optional.
+	Options func(ctx context.Context, state *FlowState) []string
+	// Handle validates the answer and puts it into the values. A UserError is told
+	// to the user, who stays at the step.
+	Handle func(ctx context.Context, state *FlowState, text string) error
+	// Next returns the name of the following step, the next one in Steps by default. Optional.
+	Next func(ctx context.Context, state *FlowState) string
+}
+
+// FlowState is what a step knows about the running flow
+type FlowState struct {
+	Msg *tgbotapi.Message
+	// Values is the pointer returned by NewValues of the flow
+	Values interface{}
+
+	flow    *Flow
+	step    string
+	history []string
+}
+
+func (f *Flow) step(name string) *Step {
+	for _, step := range f.Steps {
+		if step.Name == name {
+			return step
+		}
+	}
+
+	return nil
+}
+
+// after returns the step which follows current, nil when current is the last one
+func (f *Flow) after(ctx context.Context, state *FlowState, current *Step) *Step {
+	if current.Next != nil {
+		return f.step(current.Next(ctx, state))
+	}
+
+	for i, step := range f.Steps {
+		if step == current && i+1 < len(f.Steps) {
+			return f.Steps[i+1]
+		}
+	}
+
+	return nil
+}
+
+func (s *TgServer) registerFlows(flows ...*Flow) {
+	s.flows = make(map[string]*Flow, len(flows))
+
+	for _, flow := range flows {
+		s.flows[flow.Name] = flow
+	}
+}
+
+// startFlow puts the user at the first step of the flow. values are the initial
+// values of the flow, nil for the ones of NewValues.
+func (s *TgServer) startFlow(ctx context.Context, msg *tgbotapi.Message, name string, values interface{}) error {
+	flow := s.flows[name]
+
+	if flow == nil {
+		return fmt.Errorf("unknown flow %s", name)
+	}
+
+	if values == nil {
+		values = flow.NewValues()
+	}
+
+	state := &FlowState{Msg: msg, Values: values, flow: flow}
+
+	return s.enterStep(ctx, state, flow.Steps[0])
+}
+
+// queryMessage stands for a message of the user in the chat of the query, to start a flow from a button
+func queryMessage(query *tgbotapi.CallbackQuery) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		From: query.From,
+		Chat: query.Message.Chat,
+	}
+}
+
+// continueFlow handles the answer of a user who is in a flow
+func (s *TgServer) continueFlow(ctx context.Context, msg *tgbotapi.Message) error {
+	state, err := s.loadFlow(ctx, msg)
+
+	if err != nil {
+		return err
+	}
+
+	if state == nil {
+		return s.backToMenu(ctx, msg, "Что-то у меня амнезия... Давайте начнём сначала")
+	}
+
+	switch msg.Text {
+	case butCancel:
+		return s.backToMenu(ctx, msg, "Без вопросов")
+	case butBack:
+		if len(state.history) == 0 {
+			return s.backToMenu(ctx, msg, "Без вопросов")
+		}
+
+		state.step = state.history[len(state.history)-1]
+		state.history = state.history[:len(state.history)-1]
+
+		err = s.saveFlow(ctx, state)
+
+		if err != nil {
+			return err
+		}
+
+		return s.prompt(ctx, state, state.flow.step(state.step))
+	}
+
+	step := state.flow.step(state.step)
+
+	err = step.Handle(ctx, state, strings.TrimSpace(msg.Text))
+
+	var userErr *UserError
+
+	if errors.As(err, &userErr) {
+		return s.tell(msg, userErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	state.history = append(state.history, step.Name)
+
+	return s.enterStep(ctx, state, state.flow.after(ctx, state, step))
+}
+
+// enterStep moves the user to step, or further if it is skipped, finishing the flow after the last one
+func (s *TgServer) enterStep(ctx context.Context, state *FlowState, step *Step) error {
+	for step != nil && step.Skip != nil && step.Skip(ctx, state) {
+		step = state.flow.after(ctx, state, step)
+	}
+
+	if step == nil {
+		return s.finishFlow(ctx, state)
+	}
+
+	state.step = step.Name
+
+	err := s.saveFlow(ctx, state)
+
+	if err != nil {
+		return err
+	}
+
+	return s.prompt(ctx, state, step)
+}
+
+func (s *TgServer) prompt(ctx context.Context, state *FlowState, step *Step) error {
+	text, err := step.Prompt(ctx, state)
+
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]tgbotapi.KeyboardButton, 0, 2)
+
+	if step.Options != nil {
+		row := make([]tgbotapi.KeyboardButton, 0)
+
+		for _, option := range step.Options(ctx, state) {
+			row = append(row, tgbotapi.NewKeyboardButton(option))
+		}
+
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+
+	rows = append(rows, tgbotapi.NewKeyboardButtonRow(
+		tgbotapi.NewKeyboardButton(butBack),
+		tgbotapi.NewKeyboardButton(butCancel),
+	))
+
+	m := tgbotapi.NewMessage(state.Msg.Chat.ID, text)
+	m.ReplyMarkup = tgbotapi.NewReplyKeyboard(rows...)
+
+	_, err = s.sender.Send(m)
+	return err
+}
+
+func (s *TgServer) finishFlow(ctx context.Context, state *FlowState) error {
+	err := state.flow.Finish(ctx, state)
+
+	var userErr *UserError
+
+	if errors.As(err, &userErr) {
+		return s.tell(state.Msg, userErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.resetConversation(ctx, state.Msg.From.ID)
+
+	return nil
+}
+
+// tell answers with the text of err, the user stays at the step
+func (s *TgServer) tell(msg *tgbotapi.Message, err *UserError) error {
+	if err.Err != nil {
+		log.WithError(err.Err).WithField("user", msg.From.ID).Warn("Flow step failed")
+	}
+
+	_, sendErr := s.sender.Send(tgbotapi.NewMessage(msg.Chat.ID, err.Text))
+	return sendErr
+}
+
+// backToMenu drops the flow of the user and shows the main menu with text
+func (s *TgServer) backToMenu(ctx context.Context, msg *tgbotapi.Message, text string) error {
+	s.resetConversation(ctx, msg.From.ID)
+
+	kb := kbForAuthed
+
+	if len(forGroup(ctx)) == 0 {
+		kb = kbForNew
+	}
+
+	kb.OneTimeKeyboard = true
+
+	m := tgbotapi.NewMessage(msg.Chat.ID, text)
+	m.ReplyMarkup = kb
+
+	_, err := s.sender.Send(m)
+	return err
+}
+
+func (s *TgServer) resetConversation(_ context.Context, userID int) {
+	updateConversation(s.db, userID, func(conversation *models.Conversation) {
+		conversation.Status = UStatusUndefined
+		conversation.Values = make(map[string]string)
+	})
+}
+
+// loadFlow restores the flow the user is in, nil if it is gone, e.g. after a deploy which removed it
+func (s *TgServer) loadFlow(ctx context.Context, msg *tgbotapi.Message) (*FlowState, error) {
+	conversation, err := s.db.GetConversation(ctx, msg.From.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	flow := s.flows[conversation.Values[flowKey]]
+
+	if flow == nil || flow.step(conversation.Values[stepKey]) == nil {
+		return nil, nil
+	}
+
+	state := &FlowState{
+		Msg:    msg,
+		Values: flow.NewValues(),
+		flow:   flow,
+		step:   conversation.Values[stepKey],
+	}
+
+	if history := conversation.Values[historyKey]; history != "" {
+		state.history = strings.Split(history, ",")
+	}
+
+	err = json.Unmarshal([]byte(conversation.Values[valuesKey]), state.Values)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (s *TgServer) saveFlow(ctx context.Context, state *FlowState) error {
+	values, err := json.Marshal(state.Values)
+
+	if err != nil {
+		return err
+	}
+
+	return s.db.SaveConversation(ctx, &models.Conversation{
+		UserID: state.Msg.From.ID,
+		Status: UStatusFlow,
+		Values: map[string]string{
+			flowKey:    state.flow.Name,
+			stepKey:    state.step,
+			historyKey: strings.Join(state.history, ","),
+			valuesKey:  string(values),
+		},
+		ExpiresAt: time.Now().Add(conversationTTL),
+	})
+}
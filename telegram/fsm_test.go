@@ -0,0 +1,204 @@
+package telegram
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gungniir/telegram-quezlet-bot/database"
+	"testing"
+	"time"
+)
+
+// recordingSender keeps the texts of the messages instead of sending them
+type recordingSender struct {
+	texts []string
+}
+
+func (r *recordingSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if m, ok := c.(tgbotapi.MessageConfig); ok {
+		r.texts = append(r.texts, m.Text)
+	}
+
+	return tgbotapi.Message{}, nil
+}
+
+func (r *recordingSender) last() string {
+	if len(r.texts) == 0 {
+		return ""
+	}
+
+	return r.texts[len(r.texts)-1]
+}
+
+type testValues struct {
+	A, B, C string
+}
+
+// testFlow asks for A, B and C. B is skipped when A is "skip", C is rejected when it is "bad",
+// and the flow does not finish when C is "reject".
+func testFlow(finished **testValues) *Flow {
+	handle := func(set func(values *testValues, text string)) func(ctx context.Context, state *FlowState, text string) error {
+		return func(ctx context.Context, state *FlowState, text string) error {
+			set(state.Values.(*testValues), text)
+			return nil
+		}
+	}
+
+	prompt := func(text string) func(ctx context.Context, state *FlowState) (string, error) {
+		return func(ctx context.Context, state *FlowState) (string, error) {
+			return text, nil
+		}
+	}
+
+	return &Flow{
+		Name: "test",
+		Steps: []*Step{
+			{
+				Name:   "a",
+				Prompt: prompt("A?"),
+				Handle: handle(func(values *testValues, text string) { values.A = text }),
+			},
+			{
+				Name: "b",
+				Skip: func(ctx context.Context, state *FlowState) bool {
+					return state.Values.(*testValues).A == "skip"
+				},
+				Prompt: prompt("B?"),
+				Handle: handle(func(values *testValues, text string) { values.B = text }),
+			},
+			{
+				Name:   "c",
+				Prompt: prompt("C?"),
+				Handle: func(ctx context.Context, state *FlowState, text string) error {
+					if text == "bad" {
+						return &UserError{Text: "Bad C"}
+					}
+
+					state.Values.(*testValues).C = text
+					return nil
+				},
+			},
+		},
+		NewValues: func() interface{} {
+			return &testValues{}
+		},
+		Finish: func(ctx context.Context, state *FlowState) error {
+			values := state.Values.(*testValues)
+
+			if values.C == "reject" {
+				return &UserError{Text: "Rejected"}
+			}
+
+			*finished = values
+			return nil
+		},
+	}
+}
+
+func TestFlow(t *testing.T) {
+	tests := []struct {
+		name     string
+		inputs   []string
+		finished *testValues // nil if the flow must not finish
+		status   int
+		last     string // Last message to the user
+	}{
+		{"straight through", []string{"a1", "b1", "c1"}, &testValues{"a1", "b1", "c1"}, UStatusUndefined, ""},
+		{"skipped step", []string{"skip", "c1"}, &testValues{"skip", "", "c1"}, UStatusUndefined, ""},
+		{"back", []string{"a1", "b1", butBack, "b2", "c1"}, &testValues{"a1", "b2", "c1"}, UStatusUndefined, ""},
+		{"back over a skipped step", []string{"skip", butBack}, nil, UStatusFlow, "A?"},
+		{"back from a skipped step and on", []string{"skip", butBack, "a2", "b2", "c2"}, &testValues{"a2", "b2", "c2"}, UStatusUndefined, ""},
+		{"back from the first step", []string{butBack}, nil, UStatusUndefined, "Без вопросов"},
+		{"cancel", []string{"a1", butCancel}, nil, UStatusUndefined, "Без вопросов"},
+		{"wrong answer", []string{"a1", "b1", "bad"}, nil, UStatusFlow, "Bad C"},
+		{"wrong answer then right one", []string{"a1", "b1", "bad", "c1"}, &testValues{"a1", "b1", "c1"}, UStatusUndefined, ""},
+		{"rejected finish", []string{"a1", "b1", "reject"}, nil, UStatusFlow, "Rejected"},
+		{"rejected finish then fixed", []string{"a1", "b1", "reject", "c1"}, &testValues{"a1", "b1", "c1"}, UStatusUndefined, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			sender := &recordingSender{}
+
+			var finished *testValues
+
+			s := &TgServer{db: database.NewMemory(time.UTC, nil), sender: sender}
+			s.registerFlows(testFlow(&finished))
+
+			msg := &tgbotapi.Message{From: &tgbotapi.User{ID: 1}, Chat: &tgbotapi.Chat{ID: 1}}
+
+			err := s.startFlow(ctx, msg, "test", nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, input := range test.inputs {
+				msg.Text = input
+
+				err = s.continueFlow(ctx, msg)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			switch {
+			case test.finished == nil && finished != nil:
+				t.Errorf("flow finished with %+v", *finished)
+			case test.finished != nil && finished == nil:
+				t.Errorf("flow did not finish")
+			case test.finished != nil && *finished != *test.finished:
+				t.Errorf("flow finished with %+v, want %+v", *finished, *test.finished)
+			}
+
+			conversation, err := s.db.GetConversation(ctx, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if conversation.Status != test.status {
+				t.Errorf("status is %d, want %d", conversation.Status, test.status)
+			}
+
+			if test.last != "" && sender.last() != test.last {
+				t.Errorf("last message is %q, want %q", sender.last(), test.last)
+			}
+		})
+	}
+}
+
+func TestFlowSkipsToFinish(t *testing.T) {
+	ctx := context.Background()
+
+	var finished bool
+
+	s := &TgServer{db: database.NewMemory(time.UTC, nil), sender: &recordingSender{}}
+	s.registerFlows(&Flow{
+		Name: "skipped",
+		Steps: []*Step{{
+			Name:   "only",
+			Skip:   func(ctx context.Context, state *FlowState) bool { return true },
+			Prompt: func(ctx context.Context, state *FlowState) (string, error) { return "?", nil },
+			Handle: func(ctx context.Context, state *FlowState, text string) error { return nil },
+		}},
+		NewValues: func() interface{} { return &testValues{} },
+		Finish: func(ctx context.Context, state *FlowState) error {
+			finished = true
+			return nil
+		},
+	})
+
+	msg := &tgbotapi.Message{From: &tgbotapi.User{ID: 1}, Chat: &tgbotapi.Chat{ID: 1}}
+
+	err := s.startFlow(ctx, msg, "skipped", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !finished {
+		t.Error("flow of skipped steps did not finish at once")
+	}
+}
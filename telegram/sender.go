@@ -0,0 +1,165 @@
+package telegram
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gungniir/telegram-quezlet-bot/database"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Telegram allows about 30 messages a second overall and one a second to a chat
+	globalSendInterval = time.Second / 30
+	chatSendInterval   = time.Second
+
+	// How many times a message is resent after 429 Too Many Requests
+	maxSendRetries = 3
+)
+
+// Telegram error descriptions which mean the chat will not accept messages anymore
+var chatGoneReasons = []string{
+	"bot was blocked by the user",
+	"bot was kicked",
+	"chat not found",
+	"user is deactivated",
+	"bot can't initiate conversation",
+}
+
+// messageSender sends a message right away, Sender is the one the bot runs with
+type messageSender interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+}
+
+// Sender is the queue every outgoing message goes through. Send blocks until
+// the message fits into the Telegram rate limits, so messages leave in the
+// order they were sent.
+type Sender struct {
+	api *tgbotapi.BotAPI
+	db  database.Database
+
+	mu    sync.Mutex
+	next  time.Time           // Earliest moment for the next message
+	chats map[int64]time.Time // Earliest moment for the next message to the chat
+}
+
+func NewSender(api *tgbotapi.BotAPI, db database.Database) *Sender {
+	return &Sender{
+		api:   api,
+		db:    db,
+		chats: make(map[int64]time.Time),
+	}
+}
+
+// Send sends c as api.Send does, waiting for its turn and retrying after 429.
+// A chat which turns out to be gone is deactivated.
+func (s *Sender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	chatID := chatOf(c)
+
+	for attempt := 0; ; attempt++ {
+		time.Sleep(time.Until(s.reserve(chatID)))
+
+		msg, err := s.api.Send(c)
+
+		if chatGone(err) && chatID != 0 {
+			log.WithError(err).Infof("Chat %d is gone, deactivating it", chatID)
+
+			derr := s.db.DeactivateChat(context.Background(), chatID)
+
+			if derr != nil {
+				log.WithError(derr).Error("Failed to deactivate chat")
+			}
+
+			return msg, err
+		}
+
+		apiErr, ok := err.(tgbotapi.Error)
+
+		if !ok || apiErr.RetryAfter == 0 || attempt == maxSendRetries {
+			return msg, err
+		}
+
+		log.Warnf("Too many requests to chat %d, retrying in %d seconds", chatID, apiErr.RetryAfter)
+
+		s.pause(chatID, time.Duration(apiErr.RetryAfter)*time.Second)
+	}
+}
+
+// reserve books the earliest slot for a message to the chat and returns its moment
+func (s *Sender) reserve(chatID int64) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	slot := now
+
+	if s.next.After(slot) {
+		slot = s.next
+	}
+
+	if next, ok := s.chats[chatID]; ok && next.After(slot) {
+		slot = next
+	}
+
+	s.next = slot.Add(globalSendInterval)
+	s.chats[chatID] = slot.Add(chatSendInterval)
+
+	// Forget the chats which are free again, the map would only grow otherwise
+	for id, next := range s.chats {
+		if next.Before(now) {
+			delete(s.chats, id)
+		}
+	}
+
+	return slot
+}
+
+// pause holds the chat back for d, as Telegram asks with retry_after
+func (s *Sender) pause(chatID int64, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until := time.Now().Add(d)
+
+	if until.After(s.chats[chatID]) {
+		s.chats[chatID] = until
+	}
+}
+
+// chatGone tells whether err means that the chat will not accept messages anymore,
+// e.g. the user blocked the bot or deleted the account
+func chatGone(err error) bool {
+	apiErr, ok := err.(tgbotapi.Error)
+
+	if !ok {
+		return false
+	}
+
+	description := strings.ToLower(apiErr.Message)
+
+	for _, reason := range chatGoneReasons {
+		if strings.Contains(description, reason) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// chatOf returns the chat a message goes to, 0 for the kinds the bot does not send
+func chatOf(c tgbotapi.Chattable) int64 {
+	switch c := c.(type) {
+	case tgbotapi.MessageConfig:
+		return c.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return c.ChatID
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		return c.ChatID
+	case tgbotapi.DeleteMessageConfig:
+		return c.ChatID
+	}
+
+	return 0
+}
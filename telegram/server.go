@@ -6,8 +6,10 @@ import (
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/gungniir/telegram-quezlet-bot/database"
 	"github.com/gungniir/telegram-quezlet-bot/models"
+	"github.com/gungniir/telegram-quezlet-bot/scheduler"
 	log "github.com/sirupsen/logrus"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,8 +28,10 @@ const (
 	butLeaveGroup     = "Покинуть группу"
 )
 
+// forGroup returns the groups of the user, nil if they failed to load
 func forGroup(ctx context.Context) []*models.Group {
-	return ctx.Value(groupKey).([]*models.Group)
+	groups, _ := ctx.Value(groupKey).([]*models.Group)
+	return groups
 }
 
 var (
@@ -50,18 +54,66 @@ var (
 	)
 )
 
+var (
+	grades     = []scheduler.Grade{scheduler.GradeAgain, scheduler.GradeHard, scheduler.GradeGood, scheduler.GradeEasy}
+	gradeNames = map[scheduler.Grade]string{
+		scheduler.GradeAgain: "Забыли",
+		scheduler.GradeHard:  "Трудно",
+		scheduler.GradeGood:  "Хорошо",
+		scheduler.GradeEasy:  "Легко",
+	}
+)
+
+var (
+	snoozes     = []int{1, 3}
+	snoozeNames = map[int]string{
+		1: "Завтра",
+		3: "Через 3 дня",
+	}
+)
+
+// reviewKeyboard grades or snoozes an item opened from the given page of its digest
+func reviewKeyboard(item *models.Progress, page int) tgbotapi.InlineKeyboardMarkup {
+	gradeRow := make([]tgbotapi.InlineKeyboardButton, 0, len(grades))
+
+	for _, grade := range grades {
+		gradeRow = append(gradeRow, tgbotapi.NewInlineKeyboardButtonData(gradeNames[grade], fmt.Sprintf("SETOK:%d.%d.%d.%d", item.ID, item.Version, grade, page)))
+	}
+
+	snoozeRow := make([]tgbotapi.InlineKeyboardButton, 0, len(snoozes))
+
+	for _, days := range snoozes {
+		snoozeRow = append(snoozeRow, tgbotapi.NewInlineKeyboardButtonData(snoozeNames[days], fmt.Sprintf("SNOOZE:%d.%d.%d.%d", item.ID, item.Version, days, page)))
+	}
+
+	backRow := tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("« К списку", fmt.Sprintf("DIGEST:%d.%d", item.GroupID, page)),
+	)
+
+	return tgbotapi.NewInlineKeyboardMarkup(gradeRow, snoozeRow, backRow)
+}
+
 type TgServerConfig struct {
 	Token    string
 	Timezone *time.Location
+
+	// Daily reminders are sent at this time in Timezone
+	ReminderHour   int
+	ReminderMinute int
+
+	// Long polling is used without a webhook
+	Webhook *WebhookConfig
 }
 
 type TgServer struct {
-	Config       *TgServerConfig
-	api          *tgbotapi.BotAPI
-	stats        UserStatus
-	userContexts UserContexts
-	db           database.Database
-	ticker       *Ticker
+	Config     *TgServerConfig
+	api        *tgbotapi.BotAPI
+	sender     messageSender
+	stats      UserStatus
+	db         database.Database
+	ticker     *Ticker
+	dispatcher *Dispatcher
+	flows      map[string]*Flow
 }
 
 func (s *TgServer) ListenAndServe(db database.Database) error {
@@ -71,25 +123,47 @@ func (s *TgServer) ListenAndServe(db database.Database) error {
 		return err
 	}
 
-	wbInfo, err := api.GetWebhookInfo()
+	if s.Config.Webhook == nil {
+		wbInfo, err := api.GetWebhookInfo()
 
-	if wbInfo.IsSet() {
-		log.Warn("Webhook is set")
-		log.Warn(wbInfo.URL)
+		if wbInfo.IsSet() {
+			log.Warn("Webhook is set")
+			log.Warn(wbInfo.URL)
 
-		api.RemoveWebhook()
-	}
+			api.RemoveWebhook()
+		}
 
-	if err != nil {
-		return err
+		if err != nil {
+			return err
+		}
 	}
 
 	s.api = api
 	s.db = db
+	s.stats = UserStatus{db: db}
+
+	s.registerFlows(
+		s.createGroupFlow(), s.joinGroupFlow(), s.createItemFlow(), s.leaveGroupFlow(),
+		s.renameItemFlow(), s.setItemURLFlow(), s.settingsFlow(),
+	)
+
+	s.sender = NewSender(api, db)
+
+	s.dispatcher = new(Dispatcher)
+	s.dispatcher.StartDispatcher(s.sender, db)
 
 	s.ticker = new(Ticker)
+	s.ticker.dispatcher = s.dispatcher
 	s.ticker.timezone = s.Config.Timezone
-	s.ticker.StartTicker(api, db)
+	s.ticker.hour = s.Config.ReminderHour
+	s.ticker.minute = s.Config.ReminderMinute
+	s.ticker.StartTicker(db)
+
+	s.startSweeper()
+
+	if s.Config.Webhook != nil {
+		return s.serveWebhook()
+	}
 
 	updates, err := api.GetUpdatesChan(tgbotapi.NewUpdate(0))
 
@@ -100,112 +174,208 @@ func (s *TgServer) ListenAndServe(db database.Database) error {
 	return s.listenUpdates(updates)
 }
 
+// Updates of a user are handled in order by the same worker, different users in parallel
+const (
+	updateWorkers = 16
+	workerBuffer  = 100
+)
+
 func (s *TgServer) listenUpdates(updates tgbotapi.UpdatesChannel) error {
-	ctx := context.Background()
-	for update := range updates {
-		if update.Message != nil {
-			groups, err := s.db.GetUserGroups(ctx, update.Message.From.ID)
+	workers := make([]chan tgbotapi.Update, updateWorkers)
+	errs := make(chan error, updateWorkers)
 
-			if err != nil {
-				log.WithError(err).Warn("Failed to get user group")
-			} else {
-				ctx = context.WithValue(ctx, groupKey, groups)
+	for i := range workers {
+		workers[i] = make(chan tgbotapi.Update, workerBuffer)
+
+		go func(updates <-chan tgbotapi.Update) {
+			for update := range updates {
+				err := s.processUpdate(update)
+
+				if err == nil {
+					continue
+				}
+
+				// A failed update only concerns its user, the bot stops on fatal errors alone
+				err = s.handleError(update, err)
+
+				if err != nil {
+					errs <- err
+					return
+				}
 			}
+		}(workers[i])
+	}
 
-			_ = s.db.SetChatIDByUserID(ctx, update.Message.Chat.ID, update.Message.From.ID)
-		} else if update.CallbackQuery != nil {
-			groups, err := s.db.GetUserGroups(ctx, update.CallbackQuery.From.ID)
+	defer func() {
+		for _, worker := range workers {
+			close(worker)
+		}
+	}()
 
-			if err != nil {
-				log.WithError(err).Warn("Failed to get user group")
-			} else {
-				ctx = context.WithValue(ctx, groupKey, groups)
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return nil
+			}
+
+			select {
+			case workers[updateUserID(update)%updateWorkers] <- update:
+			case err := <-errs:
+				return err
 			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+// updateUserID returns the user an update comes from, 0 if there is none
+func updateUserID(update tgbotapi.Update) int {
+	switch {
+	case update.Message != nil && update.Message.From != nil:
+		return update.Message.From.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.From != nil:
+		return update.CallbackQuery.From.ID
+	}
 
-			_ = s.db.SetChatIDByUserID(ctx, update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.From.ID)
+	return 0
+}
+
+func (s *TgServer) handleUpdate(update tgbotapi.Update) error {
+	ctx := context.Background()
+
+	if update.Message != nil {
+		groups, err := s.db.GetUserGroups(ctx, update.Message.From.ID)
+
+		if err != nil {
+			return &UserError{Text: "Не удалось получить ваши группы, попробуйте ещё раз", Err: err}
 		}
 
-		if update.Message != nil && update.Message.IsCommand() {
-			var err error
+		ctx = context.WithValue(ctx, groupKey, groups)
+
+		_ = s.db.SetChatIDByUserID(ctx, update.Message.Chat.ID, update.Message.From.ID)
+
+		expired, err := s.expired(ctx, update.Message)
+
+		if err != nil {
+			return err
+		}
+
+		// Commands still work, anything else belonged to the forgotten flow
+		if expired && !update.Message.IsCommand() {
+			return nil
+		}
+	} else if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		groups, err := s.db.GetUserGroups(ctx, update.CallbackQuery.From.ID)
+
+		if err != nil {
+			return &UserError{Text: "Не удалось получить ваши группы, попробуйте ещё раз", Err: err}
+		}
+
+		ctx = context.WithValue(ctx, groupKey, groups)
+
+		_ = s.db.SetChatIDByUserID(ctx, update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.From.ID)
+	}
 
-			switch update.Message.Command() {
-			case "start":
-				err = s.commandStart(ctx, update.Message)
-			case "help":
-				err = s.commandHelp(ctx, update.Message)
-			case "quit":
+	if update.Message != nil && update.Message.IsCommand() {
+		var err error
+
+		switch update.Message.Command() {
+		case "start":
+			err = s.commandStart(ctx, update.Message)
+		case "help":
+			err = s.commandHelp(ctx, update.Message)
+		case "quit":
+			err = s.commandQuit(ctx, update.Message)
+		case "cancel":
+			err = s.commandCancel(ctx, update.Message)
+		case "items":
+			err = s.commandItems(ctx, update.Message)
+		case "create_item":
+			err = s.commandCreateItem(ctx, update.Message)
+		case "tick":
+			err = s.commandTick(ctx, update.Message)
+		case "time":
+			err = s.commandTime(ctx, update.Message)
+		case "stats":
+			err = s.commandStats(ctx, update.Message)
+		case "rename":
+			err = s.sendItemPicker(ctx, update.Message, "Какой модуль переименовать?", "RENAME")
+		case "edit_url":
+			err = s.sendItemPicker(ctx, update.Message, "У какого модуля поменять ссылку?", "SETURL")
+		case "delete":
+			err = s.sendItemPicker(ctx, update.Message, "Какой модуль удалить?", "DELETE")
+		case "settings":
+			err = s.commandSettings(ctx, update.Message)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	if update.Message != nil && !update.Message.IsCommand() {
+		var err error
+		status := s.stats.Get(update.Message.From.ID)
+
+		if status == UStatusUndefined {
+			switch update.Message.Text {
+			case butCreateNewGroup:
+				err = s.startFlow(ctx, update.Message, flowCreateGroup, nil)
+			case butJoinGroup:
+				err = s.startFlow(ctx, update.Message, flowJoinGroup, nil)
+			case butLeaveGroup:
 				err = s.commandQuit(ctx, update.Message)
-			case "cancel":
-				err = s.commandCancel(ctx, update.Message)
-			case "items":
+			case butGetSchedule:
 				err = s.commandItems(ctx, update.Message)
-			case "create_item":
+			case butAddModule:
 				err = s.commandCreateItem(ctx, update.Message)
-			case "tick":
-				err = s.commandTick(ctx, update.Message)
-			case "time":
-				err = s.commandTime(ctx, update.Message)
+			case butBack, butCancel: // A keyboard of a flow left behind
+				err = s.commandCancel(ctx, update.Message)
+			default:
+				err = s.defaultMessage(ctx, update.Message)
 			}
-
-			if err != nil {
-				return err
+		} else {
+			switch status {
+			case UStatusFlow:
+				err = s.continueFlow(ctx, update.Message)
+			default:
+				err = s.backToMenu(ctx, update.Message, "Что-то у меня амнезия... Давайте начнём сначала")
 			}
 		}
-		if update.Message != nil && !update.Message.IsCommand() {
-			var err error
-			status := s.stats.Get(update.Message.From.ID)
-
-			if status == UStatusUndefined {
-				switch update.Message.Text {
-				case butCreateNewGroup:
-					err = s.createGroupStart(ctx, update.Message)
-				case butJoinGroup:
-					err = s.joinGroupStart(ctx, update.Message)
-				case butLeaveGroup:
-					err = s.commandQuit(ctx, update.Message)
-				case butGetSchedule:
-					err = s.commandItems(ctx, update.Message)
-				case butAddModule:
-					err = s.commandCreateItem(ctx, update.Message)
-				default:
-					err = s.defaultMessage(ctx, update.Message)
-				}
-			} else {
-				switch s.stats.Get(update.Message.From.ID) {
-				case UStatusCreateGroupSetPassword:
-					err = s.createGroupSetPassword(ctx, update.Message)
-				case UStatusJoinGroupCheckGroup:
-					err = s.joinGroupCheckGroup(ctx, update.Message)
-				case UStatusJoinGroupCheckPassword:
-					err = s.joinGroupCheckPassword(ctx, update.Message)
-				case UStatusCreateItemSetURL:
-					err = s.createItemSetURL(ctx, update.Message)
-				case UStatusCreateItemChoseGroup:
-					err = s.createItemChoseGroup(ctx, update.Message)
-				case UStatusCreateItemSetName:
-					err = s.createItemSetName(ctx, update.Message)
-				case UStatusCreateFullItemChoseGroup:
-					err = s.createFullItemChoseGroup(ctx, update.Message)
-				case UStatusLeaveGroupChoseGroup:
-					err = s.leaveGroupChoseGroup(ctx, update.Message)
-				}
-			}
 
-			if err != nil {
-				return err
-			}
+		if err != nil {
+			return err
+		}
+	}
+	if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		var err error
+
+		switch strings.Split(update.CallbackQuery.Data, ":")[0] {
+		case "SETOK":
+			err = s.queryOk(ctx, update.CallbackQuery)
+		case "SNOOZE":
+			err = s.querySnooze(ctx, update.CallbackQuery)
+		case "DIGEST":
+			err = s.queryDigest(ctx, update.CallbackQuery)
+		case "DIGITEM":
+			err = s.queryDigestItem(ctx, update.CallbackQuery)
+		case "REVIVE":
+			err = s.queryRevive(ctx, update.CallbackQuery)
+		case "RENAME":
+			err = s.queryRename(ctx, update.CallbackQuery)
+		case "SETURL":
+			err = s.querySetURL(ctx, update.CallbackQuery)
+		case "DELETE":
+			err = s.queryDelete(ctx, update.CallbackQuery)
+		case "DELETEOK":
+			err = s.queryDeleteConfirm(ctx, update.CallbackQuery)
+		case "DELETENO":
+			err = s.queryDeleteCancel(ctx, update.CallbackQuery)
 		}
-		if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
-			var err error
-
-			switch strings.Split(update.CallbackQuery.Data, ":")[0] {
-			case "SETOK":
-				err = s.queryOk(ctx, update.CallbackQuery)
-			}
 
-			if err != nil {
-				return err
-			}
+		if err != nil {
+			return err
 		}
 	}
 
@@ -215,25 +385,10 @@ func (s *TgServer) listenUpdates(updates tgbotapi.UpdatesChannel) error {
 // Queries
 
 func (s *TgServer) queryOk(ctx context.Context, query *tgbotapi.CallbackQuery) error {
-	_, err := s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Отлично!"))
-
-	if err != nil {
-		log.WithError(err).Warn("Failed to answer query")
-		return nil
-	}
-
-	editText := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, query.Message.Text+"\nПовторили!")
-
-	_, err = s.api.Send(editText)
-	if err != nil {
-		log.WithError(err).Warn("Failed to edit text")
-		return nil
-	}
-
 	t := strings.Split(strings.Split(query.Data, ":")[1], ".")
 
 	if len(t) < 2 {
-		log.WithError(err).Warn("Failed parse. Expected 2 params")
+		log.Warn("Failed parse. Expected 2 params")
 		return nil
 	}
 
@@ -244,848 +399,813 @@ func (s *TgServer) queryOk(ctx context.Context, query *tgbotapi.CallbackQuery) e
 		return nil
 	}
 
-	counter, err := strconv.Atoi(t[1])
+	// Older reminders carry the counter, which is where the version starts from
+	version, err := strconv.Atoi(t[1])
 
 	if err != nil {
 		log.WithError(err).Warn("Failed parse data")
 		return nil
 	}
 
-	err = s.db.ProlongByItemIDWithCheck(ctx, itemID, counter)
+	// Reminders sent before grades were introduced have no grade
+	grade := scheduler.GradeGood
 
-	if err != nil {
-		log.WithError(err).Warn("Failed to next item")
-		return nil
-	}
+	if len(t) > 2 {
+		rawGrade, err := strconv.Atoi(t[2])
 
-	return nil
-}
+		if err != nil || !scheduler.Grade(rawGrade).Valid() {
+			log.WithError(err).Warn("Failed parse grade")
+			return nil
+		}
 
-// Commands
+		grade = scheduler.Grade(rawGrade)
+	}
 
-func (s *TgServer) commandHelp(_ context.Context, msg *tgbotapi.Message) error {
-	m := tgbotapi.NewMessage(msg.Chat.ID,
-		"Я напоминаю вам, каждый раз, когда приходит время освежить в памяти какие-нибудь карточки\n"+
-			"• /help - Вывести данное сообщение\n"+
-			"• /cancel - Сбросить состояние, вернуться в главное меню\n",
-	)
+	// Items graded from a digest carry its page, the older separate messages do not
+	page := -1
 
-	kb := kbForAuthed
-	kb.OneTimeKeyboard = true
+	if len(t) > 3 {
+		page, err = strconv.Atoi(t[3])
 
-	m.ReplyMarkup = kb
+		if err != nil {
+			log.WithError(err).Warn("Failed parse data")
+			return nil
+		}
+	}
 
-	_, err := s.api.Send(m)
+	today, err := s.userToday(ctx, query.From.ID)
 
-	return err
-}
+	if err != nil {
+		return err
+	}
 
-func (s *TgServer) commandStart(ctx context.Context, msg *tgbotapi.Message) error {
-	var text string
-	var kb tgbotapi.ReplyKeyboardMarkup
-	groups := forGroup(ctx)
+	item, err := s.db.ProlongByItemIDWithCheck(ctx, query.From.ID, itemID, version, grade, today)
 
-	if groups == nil {
-		text = "Я напоминаю вам, каждый раз, когда приходит время освежить в памяти какие-нибудь карточки\n" +
-			"Давайте начнём!"
-		kb = kbForNew
-	} else if len(groups) == 1 {
-		text = "С возвращением! Вы находитесь в группе √" + strconv.Itoa(groups[0].ID)
-		kb = kbForAuthed
-	} else {
-		text = "С возвращением! Вы находитесь в группах √"
+	if err != nil {
+		log.WithError(err).Warn("Failed to next item")
 
-		for _, group := range groups {
-			text += fmt.Sprintf("%d, ", group.ID)
+		_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Не получилось отметить, попробуйте ещё раз"))
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
 		}
 
-		text = text[:len(text)-2] // Удаляем лишний пробел и запятую
+		return nil
+	}
 
-		kb = kbForAuthed
+	if item == nil {
+		_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Уже отмечено"))
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
+		}
+
+		return nil
 	}
 
-	m := tgbotapi.NewMessage(msg.Chat.ID, text)
-	kb.OneTimeKeyboard = true
+	// The digest goes back to the list, so the grade is shown in the answer
+	if page >= 0 {
+		answer := tgbotapi.NewCallback(query.ID, fmt.Sprintf("Оценка: %s\nПовторим %02d.%02d.%d", gradeNames[grade], item.RepeatAt.Day(), item.RepeatAt.Month(), item.RepeatAt.Year()))
 
-	m.ReplyMarkup = kb
+		if item.Mastered() {
+			answer = tgbotapi.NewCallbackWithAlert(query.ID, fmt.Sprintf("Оценка: %s\nПоздравляю, модуль выучен! 🎓\nБольше он не будет приходить в напоминаниях, вернуть его можно в /items", gradeNames[grade]))
+		}
 
-	_, err := s.api.Send(m)
+		_, err = s.api.AnswerCallbackQuery(answer)
 
-	return err
-}
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
+		}
 
-func (s *TgServer) commandCancel(ctx context.Context, msg *tgbotapi.Message) error {
-	var kb tgbotapi.ReplyKeyboardMarkup
-	group := forGroup(ctx)
+		err = s.editDigest(ctx, query, item.GroupID, page)
 
-	if group == nil {
-		kb = kbForNew
-	} else {
-		kb = kbForAuthed
+		if err != nil {
+			log.WithError(err).Warn("Failed to show digest")
+		}
+
+		return nil
 	}
 
-	kb.OneTimeKeyboard = true
+	_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Отлично!"))
 
-	m := tgbotapi.NewMessage(msg.Chat.ID,
-		"Без вопросов",
-	)
+	if err != nil {
+		log.WithError(err).Warn("Failed to answer query")
+		return nil
+	}
 
-	m.ReplyMarkup = kb
+	editText := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+		fmt.Sprintf("%s\nОценка: %s\nПовторим %02d.%02d.%d", query.Message.Text, gradeNames[grade], item.RepeatAt.Day(), item.RepeatAt.Month(), item.RepeatAt.Year()),
+	)
 
-	s.stats.Set(msg.From.ID, UStatusUndefined)
+	if item.Mastered() {
+		editText.Text = fmt.Sprintf("%s\nОценка: %s\nПоздравляю, модуль выучен! 🎓\nБольше он не будет приходить в напоминаниях, вернуть его можно в /items", query.Message.Text, gradeNames[grade])
+	}
 
-	_, err := s.api.Send(m)
+	_, err = s.sender.Send(editText)
+	if err != nil {
+		log.WithError(err).Warn("Failed to edit text")
+		return nil
+	}
 
-	return err
+	return nil
 }
 
-func (s *TgServer) commandQuit(ctx context.Context, msg *tgbotapi.Message) error {
-	groups := forGroup(ctx)
-
-	if len(groups) == 1 {
-		kb := kbForNew
-		kb.OneTimeKeyboard = true
+func (s *TgServer) querySnooze(ctx context.Context, query *tgbotapi.CallbackQuery) error {
+	t := strings.Split(strings.Split(query.Data, ":")[1], ".")
 
-		err := s.db.RemoveUserFromGroup(ctx, msg.From.ID, groups[0].ID)
+	if len(t) < 3 {
+		log.Warn("Failed parse. Expected 3 params")
+		return nil
+	}
 
-		if err != nil {
-			log.WithError(err).Warn("Failed to remove user from group")
+	params := make([]int, 0, 3)
 
-			m := tgbotapi.NewMessage(msg.Chat.ID,
-				"Не удалось выйти из группы, увы :(",
-			)
+	for _, raw := range t[:3] {
+		param, err := strconv.Atoi(raw)
 
-			_, err = s.api.Send(m)
-			return err
+		if err != nil {
+			log.WithError(err).Warn("Failed parse data")
+			return nil
 		}
 
-		m := tgbotapi.NewMessage(msg.Chat.ID,
-			fmt.Sprintf("Вы вышли из группы √%d", groups[0].ID),
-		)
-
-		m.ReplyMarkup = kb
+		params = append(params, param)
+	}
 
-		s.stats.Set(msg.From.ID, UStatusUndefined)
+	itemID, version, days := params[0], params[1], params[2]
 
-		_, err = s.api.Send(m)
-		return err
-	} else if len(groups) == 0 {
-		kb := kbForNew
-		kb.OneTimeKeyboard = true
+	// Items snoozed from a digest carry its page, the older separate messages do not
+	page := -1
 
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Вы не находитесь в группе")
-		m.ReplyMarkup = kb
+	if len(t) > 3 {
+		var err error
 
-		s.stats.Set(msg.From.ID, UStatusUndefined)
+		page, err = strconv.Atoi(t[3])
 
-		_, err := s.api.Send(m)
-		return err
+		if err != nil {
+			log.WithError(err).Warn("Failed parse data")
+			return nil
+		}
 	}
 
-	m := tgbotapi.NewMessage(msg.Chat.ID, "Выберите группу, из которой хотите выйти")
+	if snoozeNames[days] == "" {
+		log.Warnf("Unexpected snooze for %d days", days)
+		return nil
+	}
 
-	_, err := s.api.Send(m)
+	today, err := s.userToday(ctx, query.From.ID)
 
 	if err != nil {
 		return err
 	}
 
-	m.Text = "Вы на ходитесь в группах √"
+	item, err := s.db.SnoozeByItemIDWithCheck(ctx, query.From.ID, itemID, version, days, today)
 
-	for _, group := range groups {
-		m.Text += fmt.Sprintf("%d, ", group.ID)
-	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to snooze item")
 
-	m.Text = m.Text[:len(m.Text)-2] // Убираем лишний пробел и запятую
-	_, err = s.api.Send(m)
+		_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Не получилось отложить, попробуйте ещё раз"))
 
-	s.stats.Set(msg.From.ID, UStatusLeaveGroupChoseGroup)
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
+		}
 
-	return err
-}
+		return nil
+	}
 
-func (s *TgServer) commandItems(ctx context.Context, msg *tgbotapi.Message) error {
-	var kb tgbotapi.ReplyKeyboardMarkup
-	var text string
-	groups := forGroup(ctx)
+	if item == nil {
+		_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Уже отмечено"))
 
-	if groups == nil {
-		kb = kbForNew
-		text = msgYouDoNotBelongToAnyGroup
-	} else {
-		kb = kbForAuthed
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
+		}
 
-		for _, group := range groups {
-			text += fmt.Sprintf("\n\n*Расписание группы √%d*\n", group.ID)
+		return nil
+	}
 
-			items, err := s.db.GetItemsByGroupID(ctx, group.ID)
+	if page >= 0 {
+		_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID,
+			fmt.Sprintf("Отложили до %02d.%02d.%d", item.RepeatAt.Day(), item.RepeatAt.Month(), item.RepeatAt.Year())))
 
-			if err != nil {
-				text = "Не удалось получить расписание"
-			} else {
-				for i, item := range items {
-					text += fmt.Sprintf("\n%d. (%02d.%02d.%d) %s\nСсылка на модуль: [тыц](%s)",
-						i+1, item.RepeatAt.Day(), item.RepeatAt.Month(), item.RepeatAt.Year(), item.Name, item.URL,
-					)
-				}
-			}
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
 		}
 
-		text = text[2:] // Убираем начальный \n
-	}
+		err = s.editDigest(ctx, query, item.GroupID, page)
 
-	kb.OneTimeKeyboard = true
-
-	m := tgbotapi.NewMessage(msg.Chat.ID, text)
-	m.DisableWebPagePreview = true
-	m.ReplyMarkup = kb
-	m.ParseMode = tgbotapi.ModeMarkdown
+		if err != nil {
+			log.WithError(err).Warn("Failed to show digest")
+		}
 
-	_, err := s.api.Send(m)
-	return err
-}
+		return nil
+	}
 
-func (s *TgServer) commandTick(_ context.Context, msg *tgbotapi.Message) error {
-	s.ticker.tick()
+	_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Отложили"))
 
-	m := tgbotapi.NewMessage(msg.Chat.ID, "Успешный тик")
+	if err != nil {
+		log.WithError(err).Warn("Failed to answer query")
+		return nil
+	}
 
-	kb := kbForAuthed
-	kb.OneTimeKeyboard = true
+	editText := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+		fmt.Sprintf("%s\nОтложили до %02d.%02d.%d", query.Message.Text, item.RepeatAt.Day(), item.RepeatAt.Month(), item.RepeatAt.Year()),
+	)
 
-	m.ReplyMarkup = kb
+	_, err = s.sender.Send(editText)
+	if err != nil {
+		log.WithError(err).Warn("Failed to edit text")
+		return nil
+	}
 
-	_, err := s.api.Send(m)
-	return err
+	return nil
 }
 
-func (s *TgServer) commandTime(ctx context.Context, msg *tgbotapi.Message) error {
-	nowDB, err := s.db.GetDate(ctx)
+func (s *TgServer) queryRevive(ctx context.Context, query *tgbotapi.CallbackQuery) error {
+	item := s.queryItem(ctx, query)
+
+	if item == nil {
+		return nil
+	}
+
+	today, err := s.userToday(ctx, query.From.ID)
 
 	if err != nil {
 		return err
 	}
 
-	nowApp := time.Now().In(s.Config.Timezone)
+	progress, err := s.db.ReviveItem(ctx, query.From.ID, item.ID, today)
 
-	m := tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Время в приложении: %s\nВремя в базе данных: %s", nowApp.String(), nowDB.String()))
+	if err != nil {
+		log.WithError(err).Warn("Failed to revive item")
 
-	kb := kbForAuthed
-	kb.OneTimeKeyboard = true
+		_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Не получилось вернуть модуль, попробуйте ещё раз"))
 
-	m.ReplyMarkup = kb
-
-	_, err = s.api.Send(m)
-	return err
-}
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
+		}
 
-func (s *TgServer) commandCreateItem(ctx context.Context, msg *tgbotapi.Message) error {
-	group := forGroup(ctx)
-	m := tgbotapi.NewMessage(msg.Chat.ID, "")
+		return nil
+	}
 
-	if group == nil {
-		kb := kbForNew
-		kb.OneTimeKeyboard = true
-		m.Text = msgYouDoNotBelongToAnyGroup
-		m.ReplyMarkup = kb
-	} else if len(group) == 1 {
-		m.Text = "Новый модуль? Ок... Скиньте ссылку на него"
+	if progress == nil {
+		_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Модуль уже в повторениях"))
 
-		kb := kbForAuthed
-		kb.OneTimeKeyboard = true
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
+		}
 
-		m.ReplyMarkup = kb
-		s.stats.Set(msg.From.ID, UStatusCreateItemSetURL)
-	} else {
-		m.Text = "Новый модуль? Ок... В какую группу вы хотите его добавить?"
+		return nil
+	}
 
-		kb := kbForAuthed
-		kb.OneTimeKeyboard = true
+	_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Вернули!"))
 
-		m.ReplyMarkup = kb
-		s.stats.Set(msg.From.ID, UStatusCreateItemChoseGroup)
+	if err != nil {
+		log.WithError(err).Warn("Failed to answer query")
 	}
 
-	_, err := s.api.Send(m)
+	m := tgbotapi.NewMessage(query.Message.Chat.ID,
+		fmt.Sprintf("Модуль «%s» снова в повторениях, начнём %02d.%02d.%d", progress.Name, progress.RepeatAt.Day(), progress.RepeatAt.Month(), progress.RepeatAt.Year()),
+	)
+
+	_, err = s.sender.Send(m)
 	return err
 }
 
-// CreateGroupFunctions
+// Commands
 
-func (s *TgServer) createGroupStart(ctx context.Context, msg *tgbotapi.Message) error {
-	var text string
+func (s *TgServer) commandHelp(_ context.Context, msg *tgbotapi.Message) error {
+	m := tgbotapi.NewMessage(msg.Chat.ID,
+		"Я напоминаю вам, каждый раз, когда приходит время освежить в памяти какие-нибудь карточки\n"+
+			"• /help - Вывести данное сообщение\n"+
+			"• /stats - Статистика повторений\n"+
+			"• /rename - Переименовать модуль\n"+
+			"• /edit_url - Поменять ссылку на модуль\n"+
+			"• /delete - Удалить модуль\n"+
+			"• /settings - Часовой пояс и время напоминаний\n"+
+			"• /cancel - Сбросить состояние, вернуться в главное меню\n",
+	)
 
-	groups := forGroup(ctx)
+	kb := kbForAuthed
+	kb.OneTimeKeyboard = true
 
-	if groups != nil {
-		text = "Напоминаю, что вы состоите в "
+	m.ReplyMarkup = kb
 
-		if len(groups) > 1 {
-			text += "группах"
-		} else {
-			text += "группе"
-		}
+	_, err := s.sender.Send(m)
+
+	return err
+}
+
+func (s *TgServer) commandStart(ctx context.Context, msg *tgbotapi.Message) error {
+	var text string
+	var kb tgbotapi.ReplyKeyboardMarkup
+	groups := forGroup(ctx)
 
-		text += " √"
+	if groups == nil {
+		text = "Я напоминаю вам, каждый раз, когда приходит время освежить в памяти какие-нибудь карточки\n" +
+			"Давайте начнём!"
+		kb = kbForNew
+	} else if len(groups) == 1 {
+		text = "С возвращением! Вы находитесь в группе √" + strconv.Itoa(groups[0].ID)
+		kb = kbForAuthed
+	} else {
+		text = "С возвращением! Вы находитесь в группах √"
 
 		for _, group := range groups {
 			text += fmt.Sprintf("%d, ", group.ID)
 		}
 
-		text = text[:len(text)-2] // Удаляем ненужную последнюю запятую и пробел
-
-		m := tgbotapi.NewMessage(msg.Chat.ID, text)
-
-		_, err := s.api.Send(m)
+		text = text[:len(text)-2] // Удаляем лишний пробел и запятую
 
-		if err != nil {
-			return err
-		}
+		kb = kbForAuthed
 	}
 
-	s.stats.Set(msg.From.ID, UStatusCreateGroupSetPassword)
-
-	text = "Придумайте пароль (как минимум 3 символа латиницей или цифрами)"
-
 	m := tgbotapi.NewMessage(msg.Chat.ID, text)
+	kb.OneTimeKeyboard = true
 
-	_, err := s.api.Send(m)
+	m.ReplyMarkup = kb
+
+	_, err := s.sender.Send(m)
 
 	return err
 }
 
-func (s *TgServer) createGroupSetPassword(_ context.Context, msg *tgbotapi.Message) error {
-	password := msg.Text
-
-	if !(*models.Group).CheckPassword(nil, password) {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Недопустимый пароль, попробуйте другой")
+func (s *TgServer) commandCancel(ctx context.Context, msg *tgbotapi.Message) error {
+	var kb tgbotapi.ReplyKeyboardMarkup
+	group := forGroup(ctx)
 
-		_, err := s.api.Send(m)
-		return err
+	if group == nil {
+		kb = kbForNew
+	} else {
+		kb = kbForAuthed
 	}
 
-	group, err := s.db.CreateGroup(context.Background(), (*models.Group).HashPassword(nil, password))
-
-	if err != nil {
-		log.WithError(err).Warn("Failed to create group")
-
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Не получилось создать группу, попробуйте еще раз")
+	kb.OneTimeKeyboard = true
 
-		_, err := s.api.Send(m)
-		return err
-	}
+	m := tgbotapi.NewMessage(msg.Chat.ID,
+		"Без вопросов",
+	)
 
-	err = s.db.AddUserToGroup(context.Background(), msg.From.ID, group.ID)
+	m.ReplyMarkup = kb
 
-	if err != nil {
-		log.WithError(err).Warn("Failed to attach user to group")
+	s.resetConversation(ctx, msg.From.ID)
 
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Не получилось создать группу, попробуйте еще раз")
+	_, err := s.sender.Send(m)
 
-		_, err := s.api.Send(m)
-		return err
-	}
+	return err
+}
 
-	m := tgbotapi.NewMessage(msg.Chat.ID,
-		"Отлично, группа создана!\n"+
-			"Вы можете пригласить в нее друзей по ID: "+strconv.Itoa(group.ID),
-	)
+func (s *TgServer) commandQuit(ctx context.Context, msg *tgbotapi.Message) error {
+	if len(forGroup(ctx)) == 0 {
+		kb := kbForNew
+		kb.OneTimeKeyboard = true
 
-	kb := kbForAuthed
-	kb.OneTimeKeyboard = true
+		m := tgbotapi.NewMessage(msg.Chat.ID, "Вы не находитесь в группе")
+		m.ReplyMarkup = kb
 
-	m.ReplyMarkup = kb
+		s.resetConversation(ctx, msg.From.ID)
 
-	s.stats.Set(msg.From.ID, UStatusUndefined)
+		_, err := s.sender.Send(m)
+		return err
+	}
 
-	_, err = s.api.Send(m)
-	return err
+	return s.startFlow(ctx, msg, flowLeaveGroup, nil)
 }
 
-// JoinGroupFunctions
-
-func (s *TgServer) joinGroupStart(ctx context.Context, msg *tgbotapi.Message) error {
+func (s *TgServer) commandItems(ctx context.Context, msg *tgbotapi.Message) error {
+	var kb tgbotapi.ReplyKeyboardMarkup
 	var text string
-
+	var mastered []*models.Progress
 	groups := forGroup(ctx)
 
-	if groups != nil {
-		text = "Напоминаю, что вы состоите в "
-
-		if len(groups) > 1 {
-			text += "группах"
-		} else {
-			text += "группе"
-		}
-
-		text += " √"
+	if groups == nil {
+		kb = kbForNew
+		text = msgYouDoNotBelongToAnyGroup
+	} else {
+		kb = kbForAuthed
 
 		for _, group := range groups {
-			text += fmt.Sprintf("%d, ", group.ID)
-		}
+			text += fmt.Sprintf("\n\n*Расписание группы √%d*\n", group.ID)
 
-		text = text[:len(text)-2] // Удаляем ненужную последнюю запятую и пробел
+			items, err := s.db.GetUserItemsByGroupID(ctx, msg.From.ID, group.ID)
 
-		m := tgbotapi.NewMessage(msg.Chat.ID, text)
+			if err != nil {
+				text = "Не удалось получить расписание"
+			} else {
+				i := 0
 
-		_, err := s.api.Send(m)
+				for _, item := range items {
+					if item.Mastered() {
+						mastered = append(mastered, item)
+						continue
+					}
 
-		if err != nil {
-			return err
+					i++
+					text += fmt.Sprintf("\n%d. (%02d.%02d.%d) %s\nСсылка на модуль: [тыц](%s)",
+						i, item.RepeatAt.Day(), item.RepeatAt.Month(), item.RepeatAt.Year(), item.Name, item.URL,
+					)
+				}
+			}
 		}
+
+		text = text[2:] // Убираем начальный \n
 	}
 
-	s.stats.Set(msg.From.ID, UStatusJoinGroupCheckGroup)
-	text = "Введите ID группы, к которой хотите присоединиться"
+	kb.OneTimeKeyboard = true
 
 	m := tgbotapi.NewMessage(msg.Chat.ID, text)
+	m.DisableWebPagePreview = true
+	m.ReplyMarkup = kb
+	m.ParseMode = tgbotapi.ModeMarkdown
 
-	_, err := s.api.Send(m)
+	_, err := s.sender.Send(m)
 
-	return err
-}
+	if err != nil || len(mastered) == 0 {
+		return err
+	}
 
-func (s *TgServer) joinGroupCheckGroup(ctx context.Context, msg *tgbotapi.Message) error {
-	id, err := strconv.Atoi(msg.Text)
+	// Выученные модули идут отдельным сообщением, чтобы повесить на него кнопки возврата
+	text = "*Выученные модули*\n"
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(mastered))
 
-	if err != nil {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Вы точно ввели число?")
-		_, err := s.api.Send(m)
+	for i, item := range mastered {
+		text += fmt.Sprintf("\n%d. (выучен %02d.%02d.%d) √%d %s\nСсылка на модуль: [тыц](%s)",
+			i+1, item.MasteredAt.Day(), item.MasteredAt.Month(), item.MasteredAt.Year(), item.GroupID, item.Name, item.URL,
+		)
 
-		return err
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Вернуть в повторения: "+item.Name, fmt.Sprintf("REVIVE:%d", item.ID)),
+		))
 	}
 
-	group, err := s.db.GetGroup(ctx, id)
+	m = tgbotapi.NewMessage(msg.Chat.ID, text)
+	m.DisableWebPagePreview = true
+	m.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	m.ParseMode = tgbotapi.ModeMarkdown
 
-	if err != nil {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Не удалось проверить наличие группы, попробуйте ещё раз")
-		_, err := s.api.Send(m)
+	_, err = s.sender.Send(m)
+	return err
+}
 
+// commandTick sends the user's reminder of today at once, other users get theirs on time
+func (s *TgServer) commandTick(ctx context.Context, msg *tgbotapi.Message) error {
+	reminded, err := s.ticker.remindNow(ctx, msg.From.ID, msg.Chat.ID, time.Now())
+
+	if err != nil {
 		return err
 	}
 
-	if group == nil {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Такой группы не существует, попробуйте ввести другой ID")
-		_, err := s.api.Send(m)
+	m := tgbotapi.NewMessage(msg.Chat.ID, "Успешный тик")
 
-		return err
+	if !reminded {
+		m.Text = "Сегодня напоминание уже было"
 	}
 
-	m := tgbotapi.NewMessage(msg.Chat.ID, "Хорошо, теперь введите пароль")
-	s.stats.Set(msg.From.ID, UStatusJoinGroupCheckPassword)
-
-	s.userContexts.Set(msg.From.ID, "JoinGroup_GroupID", strconv.Itoa(group.ID))
+	kb := kbForAuthed
+	kb.OneTimeKeyboard = true
 
-	_, err = s.api.Send(m)
+	m.ReplyMarkup = kb
 
+	_, err = s.sender.Send(m)
 	return err
 }
 
-func (s *TgServer) joinGroupCheckPassword(ctx context.Context, msg *tgbotapi.Message) error {
-	password := msg.Text
-	id, err := strconv.Atoi(s.userContexts.Get(msg.From.ID, "JoinGroup_GroupID"))
+func (s *TgServer) commandTime(ctx context.Context, msg *tgbotapi.Message) error {
+	nowDB, err := s.db.GetDate(ctx)
 
 	if err != nil {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Что-то пошло не так... Вернитесь в начало с помощью /cancel")
-		_, err := s.api.Send(m)
-
 		return err
 	}
 
-	if !(*models.Group).CheckPassword(nil, password) {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Неверный формат пароля, попробуйте ещё раз")
-		_, err := s.api.Send(m)
+	nowApp := time.Now().In(s.Config.Timezone)
 
-		return err
-	}
+	m := tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Время в приложении: %s\nВремя в базе данных: %s", nowApp.String(), nowDB.String()))
 
-	group, err := s.db.GetGroup(ctx, id)
+	kb := kbForAuthed
+	kb.OneTimeKeyboard = true
 
-	if err != nil {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Не удалось проверить наличие группы, попробуйте ещё раз")
-		_, err := s.api.Send(m)
+	m.ReplyMarkup = kb
 
-		return err
-	}
+	_, err = s.sender.Send(m)
+	return err
+}
 
-	if group == nil {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Группа перестала существовать... Вернитесь в начало с помощью /cancel")
-		_, err := s.api.Send(m)
+func (s *TgServer) commandStats(ctx context.Context, msg *tgbotapi.Message) error {
+	var kb tgbotapi.ReplyKeyboardMarkup
+	var text string
+	groups := forGroup(ctx)
+	now := time.Now()
 
-		return err
+	if groups == nil {
+		kb = kbForNew
+	} else {
+		kb = kbForAuthed
 	}
 
-	if group.PasswordHash != group.HashPassword(password) {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Неверный пароль, попробуйте ещё раз")
-		_, err := s.api.Send(m)
+	// Days are counted in the time zone of the viewer, except for the lines of other members
+	loc, err := s.userLocation(ctx, msg.From.ID)
 
+	if err != nil {
 		return err
 	}
 
-	err = s.db.AddUserToGroup(ctx, msg.From.ID, group.ID)
+	reviews, err := s.db.GetReviewsByUserID(ctx, msg.From.ID)
 
 	if err != nil {
-		m := tgbotapi.NewMessage(msg.Chat.ID, "Не удалось добавить вас в группу, попробуйте ещё раз")
-		_, err := s.api.Send(m)
-
-		return err
+		log.WithError(err).Warn("Failed to get user reviews")
+		text = "Не удалось получить вашу статистику"
+	} else {
+		text = "*Ваша статистика*\n" + formatReviewStats(models.NewReviewStats(reviews, now, loc))
 	}
 
-	m := tgbotapi.NewMessage(msg.Chat.ID, "Добро пожаловать в группу √"+strconv.Itoa(group.ID))
+	for _, group := range groups {
+		text += fmt.Sprintf("\n\n*Статистика группы √%d*\n", group.ID)
 
-	kb := kbForAuthed
-	kb.OneTimeKeyboard = true
+		reviews, err := s.db.GetReviewsByGroupID(ctx, group.ID)
 
-	m.ReplyMarkup = kb
+		if err != nil {
+			log.WithError(err).Warn("Failed to get group reviews")
+			text += "Не удалось получить статистику"
+			continue
+		}
 
-	s.stats.Set(msg.From.ID, UStatusUndefined)
+		text += formatReviewStats(models.NewReviewStats(reviews, now, loc))
 
-	_, err = s.api.Send(m)
+		byUser := make(map[int][]*models.Review)
+		userIDs := make([]int, 0)
 
-	return err
-}
+		for _, review := range reviews {
+			if byUser[review.UserID] == nil {
+				userIDs = append(userIDs, review.UserID)
+			}
 
-// CreateItemFunctions
+			byUser[review.UserID] = append(byUser[review.UserID], review)
+		}
 
-func (s *TgServer) createItemChoseGroup(ctx context.Context, msg *tgbotapi.Message) error {
-	groups := forGroup(ctx)
-	m := tgbotapi.NewMessage(msg.Chat.ID, "")
+		sort.Ints(userIDs)
 
-	if groups == nil {
-		m.Text = msgYouDoNotBelongToAnyGroup
-		_, err := s.api.Send(m)
-		return err
-	} else if len(groups) == 1 {
-		s.userContexts.Set(msg.From.ID, "CreateItem_Group", strconv.Itoa(groups[0].ID))
-		m.Text = fmt.Sprintf("Выбрана группа √%d", groups[0].ID)
-		_, err := s.api.Send(m)
-		if err != nil {
-			return err
-		}
-		m.Text = "А теперь скиньте ссылку на модуль"
-		_, err = s.api.Send(m)
-		s.stats.Set(msg.From.ID, UStatusCreateItemSetURL)
-		return err
-	}
+		for _, userID := range userIDs {
+			memberLoc, err := s.userLocation(ctx, userID)
 
-	groupID, err := strconv.Atoi(msg.Text)
+			if err != nil {
+				return err
+			}
 
-	if err != nil {
-		m.Text = "Вы уверены, что ввели число без всяких знаков? Повторите, пожалуйста, ещё раз"
-		_, err = s.api.Send(m)
-		return err
-	}
+			stats := models.NewReviewStats(byUser[userID], now, memberLoc)
 
-	var allowed bool
+			text += fmt.Sprintf("\n• Участник %d", userID)
 
-	for _, group := range groups {
-		if group.ID == groupID {
-			allowed = true
-			break
-		}
-	}
+			if userID == msg.From.ID {
+				text += " (вы)"
+			}
 
-	if !allowed {
-		m.Text = fmt.Sprintf("Вы не входите в группу √%d", groupID)
-		_, err = s.api.Send(m)
-		return err
+			text += fmt.Sprintf(": повторений %d, вовремя %d, серия %d дн.", stats.Total, stats.OnTime, stats.Streak)
+		}
 	}
 
-	s.userContexts.Set(msg.From.ID, "CreateItem_Group", strconv.Itoa(groupID))
-	s.stats.Set(msg.From.ID, UStatusCreateItemSetURL)
+	kb.OneTimeKeyboard = true
 
-	m.Text = "Отлично! А теперь скиньте ссылку на модуль"
-	_, err = s.api.Send(m)
+	m := tgbotapi.NewMessage(msg.Chat.ID, text)
+	m.ReplyMarkup = kb
+	m.ParseMode = tgbotapi.ModeMarkdown
 
+	_, err = s.sender.Send(m)
 	return err
 }
 
-func (s *TgServer) createItemSetURL(ctx context.Context, msg *tgbotapi.Message) error {
-	group := forGroup(ctx)
-	m := tgbotapi.NewMessage(msg.Chat.ID, "")
+func formatReviewStats(stats *models.ReviewStats) string {
+	return fmt.Sprintf("Повторений: %d\nВовремя: %d\nС опозданием: %d\nСерия: %d дн.", stats.Total, stats.OnTime, stats.Late, stats.Streak)
+}
 
-	if group == nil {
-		m.Text = msgYouDoNotBelongToAnyGroup
-		_, err := s.api.Send(m)
-		return err
-	}
+func (s *TgServer) commandCreateItem(ctx context.Context, msg *tgbotapi.Message) error {
+	if forGroup(ctx) == nil {
+		kb := kbForNew
+		kb.OneTimeKeyboard = true
 
-	url := msg.Text
+		m := tgbotapi.NewMessage(msg.Chat.ID, msgYouDoNotBelongToAnyGroup)
+		m.ReplyMarkup = kb
 
-	if !(*models.Item).CheckURL(nil, url) {
-		m.Text = "Проверьте ссылку, мне кажется, что она неверная"
-		_, err := s.api.Send(m)
+		_, err := s.sender.Send(m)
 		return err
 	}
 
-	s.userContexts.Set(msg.From.ID, "CreateItem_URL", url)
-	s.stats.Set(msg.From.ID, UStatusCreateItemSetName)
+	return s.startFlow(ctx, msg, flowCreateItem, nil)
+}
 
-	m.Text = "Окей, а теперь введите название модуля"
-	_, err := s.api.Send(m)
-	return err
+// edit item functions
+
+func inGroups(groups []*models.Group, groupID int) bool {
+	for _, group := range groups {
+		if group.ID == groupID {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (s *TgServer) createItemSetName(ctx context.Context, msg *tgbotapi.Message) error {
+func (s *TgServer) sendItemPicker(ctx context.Context, msg *tgbotapi.Message, text, prefix string) error {
 	groups := forGroup(ctx)
 	m := tgbotapi.NewMessage(msg.Chat.ID, "")
 
 	if groups == nil {
+		kb := kbForNew
+		kb.OneTimeKeyboard = true
 		m.Text = msgYouDoNotBelongToAnyGroup
-		_, err := s.api.Send(m)
+		m.ReplyMarkup = kb
+		_, err := s.sender.Send(m)
 		return err
 	}
 
-	name := msg.Text
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0)
 
-	if !(*models.Item).CheckName(nil, name) {
-		m.Text = "Ухх, плохое название, придумайте другое"
-		_, err := s.api.Send(m)
-		return err
-	}
+	for _, group := range groups {
+		items, err := s.db.GetItemsByGroupID(ctx, group.ID)
 
-	url := s.userContexts.Get(msg.From.ID, "CreateItem_URL")
+		if err != nil {
+			log.WithError(err).Warn("Failed to get group items")
+			m.Text = "Не удалось получить список модулей, попробуйте ещё раз"
+			_, err = s.sender.Send(m)
+			return err
+		}
 
-	if !(*models.Item).CheckURL(nil, url) {
-		m.Text = "Что-то у меня амнезия... Я ссылку-то уже забыл... Давайте заново? Введите /cancel"
-		_, err := s.api.Send(m)
-		return err
+		for _, item := range items {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("√%d %s", group.ID, item.Name), fmt.Sprintf("%s:%d", prefix, item.ID)),
+			))
+		}
 	}
 
-	rawGroupID := s.userContexts.Get(msg.From.ID, "CreateItem_Group")
-
-	if len(groups) > 1 && rawGroupID == "" {
-		m.Text = "Что-то у меня амнезия... Я выбранную группу уже забыл... Давайте заново? Введите /cancel"
-		_, err := s.api.Send(m)
+	if len(rows) == 0 {
+		m.Text = "В ваших группах пока нет модулей"
+		_, err := s.sender.Send(m)
 		return err
 	}
 
-	var item *models.Item
-	var err error
+	m.Text = text
+	m.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
 
-	if len(groups) > 1 {
-		groupID, _ := strconv.Atoi(rawGroupID)
-		item, err = s.db.CreateItem(ctx, groupID, url, name)
-	} else {
-		item, err = s.db.CreateItem(ctx, groups[0].ID, url, name)
+	_, err := s.sender.Send(m)
+	return err
+}
+
+// queryItem finds the item from the callback data, nil if it is gone or the user is not in its group
+func (s *TgServer) queryItem(ctx context.Context, query *tgbotapi.CallbackQuery) *models.Item {
+	answer := func(text string) {
+		_, err := s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, text))
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to answer query")
+		}
 	}
 
+	itemID, err := strconv.Atoi(strings.Split(query.Data, ":")[1])
+
 	if err != nil {
-		log.WithError(err).Error("Failed to create item")
-		m.Text = "Тэкс... Я не смогу записать... Повторите, пожалуйста, еще раз..."
-		_, err := s.api.Send(m)
-		return err
+		log.WithError(err).Warn("Failed parse data")
+		answer("")
+		return nil
 	}
 
-	s.stats.Set(msg.From.ID, UStatusUndefined)
+	item, err := s.db.GetItem(ctx, itemID)
 
-	kb := kbForAuthed
-	kb.OneTimeKeyboard = true
+	if err != nil {
+		log.WithError(err).Warn("Failed to get item")
+		answer("Не удалось найти модуль, попробуйте ещё раз")
+		return nil
+	}
 
-	m.ReplyMarkup = kb
+	if item == nil || !inGroups(forGroup(ctx), item.GroupID) {
+		answer("Этот модуль вам недоступен")
+		return nil
+	}
 
-	m.Text = fmt.Sprintf("Отлично! Карточка добавлена :)\nПовторим её %02d.%02d.%d", item.RepeatAt.Day(), item.RepeatAt.Month(), item.RepeatAt.Year())
-	_, err = s.api.Send(m)
-	return err
+	return item
 }
 
-// create full item functions
-
-func (s *TgServer) createFullItemChoseGroup(ctx context.Context, msg *tgbotapi.Message) error {
-	groups := forGroup(ctx)
-	m := tgbotapi.NewMessage(msg.Chat.ID, "")
+func (s *TgServer) queryRename(ctx context.Context, query *tgbotapi.CallbackQuery) error {
+	item := s.queryItem(ctx, query)
 
-	if groups == nil {
-		m.Text = msgYouDoNotBelongToAnyGroup
-		_, err := s.api.Send(m)
-		return err
-	} else if len(groups) == 1 {
-		s.userContexts.Set(msg.From.ID, "CreateFullItem_Group", strconv.Itoa(groups[0].ID))
-		m.Text = fmt.Sprintf("Выбрана группа √%d", groups[0].ID)
-		_, err := s.api.Send(m)
-		if err != nil {
-			return err
-		}
-		s.stats.Set(msg.From.ID, UStatusUndefined)
-		return s.createFullItemProcess(ctx, msg)
+	if item == nil {
+		return nil
 	}
 
-	groupID, err := strconv.Atoi(msg.Text)
+	_, err := s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
 
 	if err != nil {
-		m.Text = "Вы уверены, что ввели число без всяких знаков? Повторите, пожалуйста, ещё раз"
-		_, err = s.api.Send(m)
-		return err
+		log.WithError(err).Warn("Failed to answer query")
 	}
 
-	var allowed bool
+	return s.startFlow(ctx, queryMessage(query), flowRenameItem, &editItemValues{ItemID: item.ID, ItemName: item.Name})
+}
 
-	for _, group := range groups {
-		if group.ID == groupID {
-			allowed = true
-			break
-		}
-	}
+func (s *TgServer) querySetURL(ctx context.Context, query *tgbotapi.CallbackQuery) error {
+	item := s.queryItem(ctx, query)
 
-	if !allowed {
-		m.Text = fmt.Sprintf("Вы не входите в группу √%d", groupID)
-		_, err = s.api.Send(m)
-		return err
+	if item == nil {
+		return nil
 	}
 
-	s.userContexts.Set(msg.From.ID, "CreateFullItem_Group", strconv.Itoa(groupID))
-	s.stats.Set(msg.From.ID, UStatusUndefined)
-
-	return s.createFullItemProcess(ctx, msg)
-}
+	_, err := s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
 
-func (s *TgServer) createFullItemProcess(ctx context.Context, msg *tgbotapi.Message) error {
-	rawModule := s.userContexts.Get(msg.From.ID, "CreateFullItem_Module")
-	rawGroupID := s.userContexts.Get(msg.From.ID, "CreateFullItem_Group")
+	if err != nil {
+		log.WithError(err).Warn("Failed to answer query")
+	}
 
-	groupID, _ := strconv.Atoi(rawGroupID)
+	return s.startFlow(ctx, queryMessage(query), flowSetItemURL, &editItemValues{ItemID: item.ID, ItemName: item.Name})
+}
 
-	values := newModuleRegex.FindAllStringSubmatch(rawModule, 1)
-	name := values[0][1]
-	url := values[0][2]
+func (s *TgServer) queryDelete(ctx context.Context, query *tgbotapi.CallbackQuery) error {
+	item := s.queryItem(ctx, query)
 
-	m := tgbotapi.NewMessage(msg.Chat.ID, "")
+	if item == nil {
+		return nil
+	}
 
-	item, err := s.db.CreateItem(ctx, groupID, url, name)
+	_, err := s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
 
 	if err != nil {
-		log.WithError(err).Error("Failed to create item")
-		m.Text = "Тэкс... Я не смогу записать... Повторите, пожалуйста, еще раз..."
-		_, err := s.api.Send(m)
-		return err
+		log.WithError(err).Warn("Failed to answer query")
 	}
 
-	s.stats.Set(msg.From.ID, UStatusUndefined)
+	editText := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+		fmt.Sprintf("Удалить модуль «%s» из группы √%d? Прогресс всех участников по нему пропадёт", item.Name, item.GroupID),
+	)
 
-	m.Text = fmt.Sprintf("Отлично! Карточка добавлена в группу √%d :)\nНазвание: %s\nСсылка: [тыц](%s)\nПовторим её %02d.%02d.%d", groupID, item.Name, item.URL, item.RepeatAt.Day(), item.RepeatAt.Month(), item.RepeatAt.Year())
-	m.ParseMode = tgbotapi.ModeMarkdown
-	m.ReplyMarkup = kbForAuthed
+	kb := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Да, удалить", fmt.Sprintf("DELETEOK:%d", item.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("Нет", fmt.Sprintf("DELETENO:%d", item.ID)),
+	))
+	editText.ReplyMarkup = &kb
 
-	_, err = s.api.Send(m)
+	_, err = s.sender.Send(editText)
 	return err
 }
 
-// leave group functions
+func (s *TgServer) queryDeleteConfirm(ctx context.Context, query *tgbotapi.CallbackQuery) error {
+	item := s.queryItem(ctx, query)
 
-func (s *TgServer) leaveGroupChoseGroup(ctx context.Context, msg *tgbotapi.Message) error {
-	kb := kbForAuthed
-	kb.OneTimeKeyboard = true
+	if item == nil {
+		return nil
+	}
 
-	groups := forGroup(ctx)
+	err := s.db.DeleteItem(ctx, item.ID)
 
-	m := tgbotapi.NewMessage(msg.Chat.ID, "")
+	if err != nil {
+		log.WithError(err).Warn("Failed to delete item")
 
-	if groups == nil {
-		m.Text = msgYouDoNotBelongToAnyGroup
-		_, err := s.api.Send(m)
-		return err
-	} else if len(groups) == 1 {
-		m.Text = fmt.Sprintf("Выбрана группа √%d", groups[0].ID)
-		_, err := s.api.Send(m)
-		if err != nil {
-			return err
-		}
+		_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Не удалось удалить модуль, попробуйте ещё раз"))
 
-		err = s.db.RemoveUserFromGroup(ctx, msg.From.ID, groups[0].ID)
-		if err != nil {
-			return err
-		}
 		if err != nil {
-			m.Text = "Произошла неизвестная ошибка при выходе из группы, попробуйте ещё раз"
-			_, err = s.api.Send(m)
-			return err
+			log.WithError(err).Warn("Failed to answer query")
 		}
 
-		s.stats.Set(msg.From.ID, UStatusUndefined)
-
-		m.Text = fmt.Sprintf("Вы вышли из группы √%d", groups[0].ID)
-		m.ReplyMarkup = kb
-		_, err = s.api.Send(m)
-		return err
+		return nil
 	}
 
-	groupID, err := strconv.Atoi(msg.Text)
+	_, err = s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Удалено"))
 
 	if err != nil {
-		m.Text = "Вы уверены, что ввели число без всяких знаков? Повторите, пожалуйста, ещё раз"
-		_, err = s.api.Send(m)
-		return err
+		log.WithError(err).Warn("Failed to answer query")
 	}
 
-	var allowed bool
-
-	for _, group := range groups {
-		if group.ID == groupID {
-			allowed = true
-			break
-		}
-	}
+	editText := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, fmt.Sprintf("Модуль «%s» удалён", item.Name))
 
-	if !allowed {
-		m.Text = fmt.Sprintf("Вы не входите в группу √%d", groupID)
-		_, err = s.api.Send(m)
-		return err
-	}
+	_, err = s.sender.Send(editText)
+	return err
+}
 
-	err = s.db.RemoveUserFromGroup(ctx, msg.From.ID, groupID)
+func (s *TgServer) queryDeleteCancel(_ context.Context, query *tgbotapi.CallbackQuery) error {
+	_, err := s.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
 
 	if err != nil {
-		m.Text = "Произошла неизвестная ошибка при выходе из группы, попробуйте ещё раз"
-		_, err = s.api.Send(m)
-		return err
+		log.WithError(err).Warn("Failed to answer query")
 	}
 
-	s.stats.Set(msg.From.ID, UStatusUndefined)
+	editText := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, "Хорошо, ничего не удаляем")
 
-	m.Text = fmt.Sprintf("Вы вйшли из группы √%d", groupID)
-	m.ReplyMarkup = kb
-	_, err = s.api.Send(m)
+	_, err = s.sender.Send(editText)
 	return err
 }
 
+// settings functions
+
+func (s *TgServer) commandSettings(ctx context.Context, msg *tgbotapi.Message) error {
+	return s.startFlow(ctx, msg, flowSettings, nil)
+}
+
 // default
 
 func (s *TgServer) defaultMessage(ctx context.Context, msg *tgbotapi.Message) error {
 	groups := forGroup(ctx)
 
 	switch {
-	case len(groups) == 1 && newModuleRegex.MatchString(msg.Text):
-		s.userContexts.Set(msg.From.ID, "CreateFullItem_Module", msg.Text)
-		s.userContexts.Set(msg.From.ID, "CreateFullItem_Group", strconv.Itoa(groups[0].ID))
-
-		return s.createFullItemProcess(ctx, msg)
-	case len(groups) > 1 && newModuleRegex.MatchString(msg.Text):
-		s.userContexts.Set(msg.From.ID, "CreateFullItem_Module", msg.Text)
-
-		m := tgbotapi.NewMessage(msg.Chat.ID, "")
-
-		m.Text = "Введите номер группы, в которую хотите добавить эту карточку"
-		_, err := s.api.Send(m)
-
-		if err != nil {
-			return err
-		}
-
-		m.Text = "Вы находитесь в группах √"
-
-		for _, group := range groups {
-			m.Text += fmt.Sprintf("%d, ", group.ID)
-		}
-
-		m.Text = m.Text[:len(m.Text)-2] // Удаляем лишнюю запятую и пробел
-
-		_, err = s.api.Send(m)
-		if err != nil {
-			return err
-		}
-
-		s.stats.Set(msg.From.ID, UStatusCreateFullItemChoseGroup)
-		return nil
+	case len(groups) > 0 && newModuleRegex.MatchString(msg.Text):
+		values := newModuleRegex.FindStringSubmatch(msg.Text)
+
+		return s.startFlow(ctx, msg, flowCreateItem, &createItemValues{
+			Name:   values[1],
+			URL:    values[2],
+			Shared: true,
+		})
 	default:
 		m := tgbotapi.NewMessage(msg.Chat.ID, "Не понимаю, что вы имели в виду...")
 
@@ -1095,7 +1215,7 @@ func (s *TgServer) defaultMessage(ctx context.Context, msg *tgbotapi.Message) er
 			m.ReplyMarkup = kbForNew
 		}
 
-		_, err := s.api.Send(m)
+		_, err := s.sender.Send(m)
 
 		if err != nil {
 			log.WithError(err).Error("Failed to send default msg")
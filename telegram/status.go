@@ -1,44 +1,34 @@
 package telegram
 
-import "sync"
+import (
+	"context"
+	"github.com/gungniir/telegram-quezlet-bot/database"
+	log "github.com/sirupsen/logrus"
+)
 
+// UserStatus tells whether the user is in a flow. It is kept in the database,
+// so that a flow survives restarts and any replica can continue it.
 type UserStatus struct {
-	store map[int]int
-	mu    sync.RWMutex
-}
-
-func (u *UserStatus) Set(userID, status int) {
-	if u.store == nil {
-		u.store = make(map[int]int)
-	}
-	u.mu.Lock()
-	u.store[userID] = status
-	u.mu.Unlock()
+	db database.Database
 }
 
 func (u *UserStatus) Get(userID int) int {
-	if u.store == nil {
+	conversation, err := u.db.GetConversation(context.Background(), userID)
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to get conversation")
 		return UStatusUndefined
 	}
-	u.mu.RLock()
-	status := u.store[userID]
-	u.mu.RUnlock()
-	return status
+
+	return conversation.Status
 }
 
+// Statuses are stored in the database by number, so a number is never reused
 const (
-	UStatusUndefined = iota
-
-	UStatusCreateGroupSetPassword
-
-	UStatusJoinGroupCheckGroup
-	UStatusJoinGroupCheckPassword
-
-	UStatusCreateItemChoseGroup
-	UStatusCreateItemSetURL
-	UStatusCreateItemSetName
+	UStatusUndefined = 0
 
-	UStatusCreateFullItemChoseGroup
+	// 1-12 were the steps of the flows now run by the state machine
 
-	UStatusLeaveGroupChoseGroup
+	// The user is in a Flow, its step is kept in the conversation values
+	UStatusFlow = 13
 )
@@ -2,127 +2,240 @@ package telegram
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/gungniir/telegram-quezlet-bot/database"
+	"github.com/gungniir/telegram-quezlet-bot/models"
 	log "github.com/sirupsen/logrus"
+	"sort"
 	"time"
 )
 
+// Ticker sends every user their daily reminder at the user's own local time.
+// timezone, hour and minute are the defaults for users without settings.
 type Ticker struct {
-	api      *tgbotapi.BotAPI
-	db       database.Database
-	timezone *time.Location
+	db         database.Database
+	dispatcher *Dispatcher
+	timezone   *time.Location
+	hour       int
+	minute     int
+	leader     bool
 }
 
-func (t *Ticker) StartTicker(api *tgbotapi.BotAPI, db database.Database) {
-	t.api = api
+func (t *Ticker) StartTicker(db database.Database) {
 	t.db = db
 
 	log.Info("Start ticker")
 
 	go func() {
-		for {
-			now := time.Now().In(t.timezone)
-			to := time.Date(now.Year(), now.Month(), now.Day()+1, 4, 30, 0, 0, t.timezone)
+		// Catch up on the reminders missed while the bot was down
+		if t.lead() {
+			t.tick(time.Now())
+		}
 
-			log.Infof("Sleep until %s", to)
+		for {
+			// Users may pick any minute of the day, so wake up every minute
+			to := time.Now().Truncate(time.Minute).Add(time.Minute)
 
 			time.Sleep(time.Until(to))
 
-			t.tick()
+			if t.lead() {
+				t.tick(to)
+			}
 		}
 	}()
 }
 
-func (t *Ticker) tick() {
-	log.Info("Tick")
-
-	err := t.db.ProlongYesterdayItem(context.Background())
+// lead tells whether this replica is the one to send reminders
+func (t *Ticker) lead() bool {
+	leader, err := t.db.IsLeader(context.Background())
 
 	if err != nil {
-		log.WithError(err).Error("Failed to prolong yesterday packages")
+		log.WithError(err).Error("Failed to check leadership")
+	}
+
+	if leader != t.leader {
+		if leader {
+			log.Info("Became the leader, sending reminders")
+		} else {
+			log.Info("Not the leader anymore, leaving reminders to another replica")
+		}
+
+		t.leader = leader
 	}
 
-	items, err := t.db.GetTodayItems(context.Background())
+	return leader
+}
+
+// schedule returns the user's time zone and reminder time in minutes after local midnight
+func (t *Ticker) schedule(settings *models.UserSettings) (*time.Location, int) {
+	loc := t.timezone
+	remindAt := t.hour*60 + t.minute
+
+	if settings.Timezone != "" {
+		userLoc, err := time.LoadLocation(settings.Timezone)
 
-	log.Infof("Today items count: %d", len(items))
+		if err != nil {
+			log.WithError(err).Warnf("Bad timezone of user %d", settings.UserID)
+		} else {
+			loc = userLoc
+		}
+	}
+
+	if settings.RemindAt != nil {
+		remindAt = *settings.RemindAt
+	}
+
+	return loc, remindAt
+}
+
+// tick reminds users whose reminder time has come and who have not been reminded
+// today yet. Every user is reminded at most once a day.
+func (t *Ticker) tick(now time.Time) {
+	list, err := t.db.GetUserSettingsList(context.Background())
 
 	if err != nil {
-		log.WithError(err).Error("Failed to get today items")
+		log.WithError(err).Error("Failed to get user settings")
 		return
 	}
 
-	itemIDs := make([]int, 0, 10)
+	today := make(map[int]time.Time)
+	userIDs := make([]int, 0)
+
+	for _, settings := range list {
+		loc, remindAt := t.schedule(settings)
+		local := now.In(loc)
+		date := localDate(now, loc)
+
+		if settings.RemindedOn != nil && !settings.RemindedOn.Before(date) {
+			continue
+		}
+
+		if local.Hour()*60+local.Minute() < remindAt {
+			continue
+		}
 
-	for _, item := range items {
-		itemIDs = append(itemIDs, item.ID)
+		today[settings.UserID] = date
+		userIDs = append(userIDs, settings.UserID)
 	}
 
-	chatIDs, err := t.db.GetChatIDsByItemIDs(context.Background(), itemIDs)
+	if len(userIDs) == 0 {
+		return
+	}
 
-	log.Infof("Today chats count: %d", len(chatIDs))
+	log.Infof("Tick for %d users", len(userIDs))
+
+	chatIDs, err := t.db.GetChatIDsByUserIDs(context.Background(), userIDs)
 
 	if err != nil {
 		log.WithError(err).Error("Failed to get chatIDs")
 		return
 	}
 
-	{
-		notified := make(map[int64]bool)
+	sort.Ints(userIDs)
 
-		for _, chatIDs := range chatIDs {
-			for _, chatID := range chatIDs {
-				if notified[chatID] {
-					continue
-				}
-				notified[chatID] = true
+	for _, userID := range userIDs {
+		chatID, ok := chatIDs[userID]
 
-				m := tgbotapi.NewMessage(chatID, "Доброе утро! Соскучились по модулям? А они-то как по вас?)\nВ общем, пора учиться :)")
+		if !ok {
+			continue
+		}
 
-				_, err := t.api.Send(m)
+		_, err := t.remind(userID, chatID, today[userID])
 
-				if err != nil {
-					log.WithError(err).Warn("Failed to send message to chat")
-				}
-			}
+		if err != nil {
+			log.WithError(err).Errorf("Failed to remind user %d", userID)
 		}
 	}
+}
+
+// remind enqueues the reminder of the user, false if they have already been reminded today. Nothing
+// is marked until the messages are in the outbox, so a failed reminder is retried on the next tick.
+func (t *Ticker) remind(userID int, chatID int64, today time.Time) (bool, error) {
+	messages, err := t.reminder(userID, chatID, today)
+
+	if err != nil {
+		return false, err
+	}
 
-	lastGroups := make(map[int64]int)
+	// Claiming is atomic, so a concurrent /tick can not remind the user twice
+	claimed, err := t.db.ClaimReminder(context.Background(), userID, today, messages)
 
-	for _, item := range items {
-		for _, chatID := range chatIDs[item.ID] {
-			lastGroup := lastGroups[chatID]
+	if err != nil {
+		return false, fmt.Errorf("claim reminder: %w", err)
+	}
 
-			if lastGroup != item.GroupID {
-				m := tgbotapi.NewMessage(chatID, fmt.Sprintf("*Модули группы √%d*", item.GroupID))
-				m.ParseMode = tgbotapi.ModeMarkdown
+	if claimed && len(messages) > 0 {
+		t.dispatcher.Wake()
+	}
 
-				_, err = t.api.Send(m)
-				log.WithError(err).Warn("Failed to send message to chat")
+	return claimed, nil
+}
 
-				lastGroups[chatID] = item.GroupID
-			}
+// remindNow sends the user their reminder of today ahead of their reminder time, which
+// is not sent again then. False if they have already been reminded today.
+func (t *Ticker) remindNow(ctx context.Context, userID int, chatID int64, now time.Time) (bool, error) {
+	settings, err := t.db.GetUserSettings(ctx, userID)
 
-			m := tgbotapi.NewMessage(chatID,
-				fmt.Sprintf("%s\n[Тыц по ссылке](%s)", item.Name, item.URL),
-			)
+	if err != nil {
+		return false, err
+	}
 
-			m.DisableWebPagePreview = true
-			m.DisableNotification = true
-			m.ParseMode = tgbotapi.ModeMarkdown
-			m.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("Повторили!", fmt.Sprintf("SETOK:%d.%d", item.ID, item.Counter)),
-				),
-			)
+	loc, _ := t.schedule(settings)
 
-			_, err := t.api.Send(m)
+	return t.remind(userID, chatID, localDate(now, loc))
+}
 
-			if err != nil {
-				log.WithError(err).Warn("Failed to send message to chat")
-			}
+// reminder returns the messages of the user's reminder, none if nothing is due today
+func (t *Ticker) reminder(userID int, chatID int64, today time.Time) ([]*models.OutboxMessage, error) {
+	err := t.db.ProlongYesterdayItem(context.Background(), userID, today)
+
+	if err != nil {
+		return nil, fmt.Errorf("prolong yesterday items: %w", err)
+	}
+
+	items, err := t.db.GetTodayItems(context.Background(), userID, today)
+
+	if err != nil {
+		return nil, fmt.Errorf("get today items: %w", err)
+	}
+
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	messages := []*models.OutboxMessage{{
+		ChatID: chatID,
+		Text:   "Доброе утро! Соскучились по модулям? А они-то как по вас?)\nВ общем, пора учиться :)",
+	}}
+
+	// Items come ordered by group, every group gets a digest of its own
+	for from := 0; from < len(items); {
+		to := from
+
+		for to < len(items) && items[to].GroupID == items[from].GroupID {
+			to++
 		}
+
+		text, kb := digestMessage(items[from].GroupID, items[from:to], 0)
+
+		keyboard, err := json.Marshal(kb)
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, &models.OutboxMessage{
+			ChatID:    chatID,
+			Text:      text,
+			ParseMode: tgbotapi.ModeHTML,
+			Keyboard:  string(keyboard),
+			Silent:    true,
+		})
+
+		from = to
 	}
+
+	return messages, nil
 }
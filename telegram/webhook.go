@@ -0,0 +1,106 @@
+package telegram
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+)
+
+// WebhookConfig makes the server receive updates over HTTP instead of long polling
+type WebhookConfig struct {
+	URL    string // Public URL registered with Telegram
+	Listen string
+	Path   string
+	Secret string // Required, Telegram sends it with every update
+
+	// Served over plain HTTP when empty, e.g. behind a reverse proxy
+	CertFile string
+	KeyFile  string
+}
+
+// setWebhook registers the webhook, tgbotapi knows nothing about the secret token.
+// The certificate is uploaded along, so that a self-signed one is trusted.
+func (s *TgServer) setWebhook() error {
+	if s.Config.Webhook.CertFile != "" {
+		params := map[string]string{
+			"url":          s.Config.Webhook.URL,
+			"secret_token": s.Config.Webhook.Secret,
+		}
+
+		_, err := s.api.UploadFile("setWebhook", params, "certificate", s.Config.Webhook.CertFile)
+		return err
+	}
+
+	v := url.Values{}
+	v.Add("url", s.Config.Webhook.URL)
+	v.Add("secret_token", s.Config.Webhook.Secret)
+
+	_, err := s.api.MakeRequest("setWebhook", v)
+	return err
+}
+
+// serveWebhook receives updates until the HTTP server fails, handing them to listenUpdates
+func (s *TgServer) serveWebhook() error {
+	err := s.setWebhook()
+
+	if err != nil {
+		return err
+	}
+
+	updates := make(chan tgbotapi.Update, s.api.Buffer)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.Config.Webhook.Path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		secret := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+
+		// An empty secret would let anybody post updates, the config does not allow it
+		if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.Config.Webhook.Secret)) != 1 {
+			log.Warnf("Webhook request from %s with a wrong secret", r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var update tgbotapi.Update
+
+		err := json.NewDecoder(r.Body).Decode(&update)
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to decode webhook update")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		updates <- update
+	})
+
+	server := &http.Server{
+		Addr:    s.Config.Webhook.Listen,
+		Handler: mux,
+	}
+
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- s.listenUpdates(updates)
+	}()
+
+	go func() {
+		log.Infof("Listen for webhook on %s%s", s.Config.Webhook.Listen, s.Config.Webhook.Path)
+
+		if s.Config.Webhook.CertFile != "" {
+			errs <- server.ListenAndServeTLS(s.Config.Webhook.CertFile, s.Config.Webhook.KeyFile)
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+
+	return <-errs
+}